@@ -0,0 +1,528 @@
+package workspace
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+
+	"github.com/kuttiproject/kuttilog"
+)
+
+const (
+	// DefaultMaxExtractSize is the default limit on the total size of files
+	// extracted by ExtractArchive.
+	DefaultMaxExtractSize int64 = 16 << 30
+	// DefaultMaxExtractEntries is the default limit on the number of entries
+	// extracted by ExtractArchive.
+	DefaultMaxExtractEntries = 100000
+)
+
+// ErrArchiveLimitExceeded is returned, wrapped, when an archive being
+// extracted exceeds the size or entry limits.
+var ErrArchiveLimitExceeded = errors.New("archive exceeds extraction limits")
+
+// UnsafeArchiveEntryError is returned when an archive contains an entry
+// that would be extracted outside the destination directory.
+type UnsafeArchiveEntryError struct {
+	Name   string
+	Reason string
+}
+
+func (ue *UnsafeArchiveEntryError) Error() string {
+	return fmt.Sprintf("unsafe archive entry %s: %s", ue.Name, ue.Reason)
+}
+
+// ExtractOptions control the behaviour of ExtractArchive.
+type ExtractOptions struct {
+	// Format is "tar" or "zip". If empty, the format and compression are
+	// detected from the archive's file name, such as .zip, .tar, .tar.gz or
+	// .tgz.
+	Format string
+	// Compression is the registered compression format of a tar archive,
+	// such as "gzip". If empty, and Format is specified, the archive is not
+	// compressed.
+	Compression string
+	// MaxSize limits the total size of extracted files. If 0,
+	// DefaultMaxExtractSize is used. If negative, there is no limit.
+	MaxSize int64
+	// MaxEntries limits the number of entries extracted. If 0,
+	// DefaultMaxExtractEntries is used. If negative, there is no limit.
+	MaxEntries int
+	// Progress, if not nil, is called as the archive is extracted. For tar
+	// archives, it reports bytes of the archive file read so far, and its
+	// size. For zip archives, it reports bytes of files extracted so far,
+	// and their total size.
+	Progress ProgressFunc
+}
+
+// tarshorthands map single extensions of compressed tar archives to their
+// full form.
+var tarshorthands = map[string]string{
+	".tgz":  ".tar.gz",
+	".tbz2": ".tar.bz2",
+	".txz":  ".tar.xz",
+	".tzst": ".tar.zst",
+}
+
+// ExtractArchive extracts a tar or zip archive into a destination directory,
+// which is created if needed. Compressed tar archives are supported for any
+// registered compression format.
+//
+// Entries with absolute paths, paths leading outside the destination, or
+// symbolic links pointing outside it are refused with an
+// *UnsafeArchiveEntryError, as are entries that would be written through a
+// symbolic link. Extraction stops with ErrArchiveLimitExceeded if the
+// archive exceeds the limits in the options. Permission bits of files and
+// directories are preserved, but not ownership. Existing files are
+// replaced. If extraction fails, files extracted so far are left in place.
+// The options parameter can be nil.
+func ExtractArchive(sourcepath string, destdir string, options *ExtractOptions) error {
+	extractoptions := ExtractOptions{}
+	if options != nil {
+		extractoptions = *options
+	}
+
+	format, compression, err := archiveformat(sourcepath, extractoptions.Format, extractoptions.Compression)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(destdir, 0755); err != nil {
+		return err
+	}
+	destdir, err = filepath.Abs(destdir)
+	if err != nil {
+		return err
+	}
+
+	x := &extractor{
+		destdir:    destdir,
+		maxsize:    extractoptions.MaxSize,
+		maxentries: extractoptions.MaxEntries,
+	}
+	if x.maxsize == 0 {
+		x.maxsize = DefaultMaxExtractSize
+	}
+	if x.maxentries == 0 {
+		x.maxentries = DefaultMaxExtractEntries
+	}
+
+	kuttilog.Printf(kuttilog.Debug, "Extracting %s archive %s to %s...", format, sourcepath, destdir)
+
+	if format == "zip" {
+		return x.extractzip(sourcepath, extractoptions.Progress)
+	}
+
+	return x.extracttar(sourcepath, compression, extractoptions.Progress)
+}
+
+// archiveformat returns the format and compression of an archive, detecting
+// them from its name if no format is specified.
+func archiveformat(name string, format string, compression string) (string, string, error) {
+	switch format {
+	case "zip", "tar":
+		return format, compression, nil
+	case "":
+	default:
+		return "", "", fmt.Errorf("unsupported archive format %s", format)
+	}
+
+	lowername := strings.ToLower(name)
+	if strings.HasSuffix(lowername, ".zip") {
+		return "zip", "", nil
+	}
+	for short, long := range tarshorthands {
+		if strings.HasSuffix(lowername, short) {
+			lowername = strings.TrimSuffix(lowername, short) + long
+		}
+	}
+
+	decompressorlock.RLock()
+	detected, trimmed := compressionforname(lowername)
+	decompressorlock.RUnlock()
+
+	if !strings.HasSuffix(trimmed, ".tar") {
+		return "", "", fmt.Errorf("cannot detect archive format of %s", name)
+	}
+	if compression == "" {
+		compression = detected
+	}
+
+	return "tar", compression, nil
+}
+
+// extractor extracts archive entries into a directory, enforcing safety
+// checks and limits.
+type extractor struct {
+	destdir    string
+	maxsize    int64
+	maxentries int
+	entries    int
+	written    int64
+	total      int64
+	progress   ProgressFunc
+}
+
+func (x *extractor) extracttar(sourcepath string, compression string, progress ProgressFunc) error {
+	decompressor, err := finddecompressor(compression, "", "")
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Open(sourcepath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var source io.Reader = f
+	if progress != nil {
+		fileinfo, err := f.Stat()
+		if err != nil {
+			return err
+		}
+		source = &progressreader{f, 0, fileinfo.Size(), progress}
+	}
+	if decompressor != nil {
+		reader, err := decompressor(source)
+		if err != nil {
+			return err
+		}
+		defer reader.Close()
+		source = reader
+	}
+
+	tr := tar.NewReader(source)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = x.mkdir(header.Name, header.FileInfo().Mode())
+		case tar.TypeReg:
+			err = x.writefile(header.Name, header.FileInfo().Mode(), tr)
+		case tar.TypeSymlink:
+			err = x.symlink(header.Name, header.Linkname)
+		case tar.TypeLink:
+			err = x.hardlink(header.Name, header.Linkname)
+		case tar.TypeXGlobalHeader:
+			continue
+		default:
+			kuttilog.Printf(kuttilog.Debug, "Skipping archive entry %s of type %c.", header.Name, header.Typeflag)
+			err = x.addentry()
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (x *extractor) extractzip(sourcepath string, progress ProgressFunc) error {
+	zr, err := zip.OpenReader(sourcepath)
+	if err != nil {
+		return err
+	}
+	defer zr.Close()
+
+	if x.maxentries > 0 && len(zr.File) > x.maxentries {
+		return fmt.Errorf("%w: more than %v entries", ErrArchiveLimitExceeded, x.maxentries)
+	}
+
+	x.progress = progress
+	for _, file := range zr.File {
+		x.total += int64(file.UncompressedSize64)
+	}
+
+	for _, file := range zr.File {
+		if err := x.extractzipfile(file); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (x *extractor) extractzipfile(file *zip.File) error {
+	mode := file.Mode()
+	if mode.IsDir() {
+		return x.mkdir(file.Name, mode)
+	}
+
+	rc, err := file.Open()
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+
+	if mode&fs.ModeSymlink != 0 {
+		linkname, err := io.ReadAll(io.LimitReader(rc, 4096))
+		if err != nil {
+			return err
+		}
+		return x.symlink(file.Name, string(linkname))
+	}
+
+	return x.writefile(file.Name, mode, rc)
+}
+
+// addentry counts an entry against the entry limit.
+func (x *extractor) addentry() error {
+	x.entries++
+	if x.maxentries > 0 && x.entries > x.maxentries {
+		return fmt.Errorf("%w: more than %v entries", ErrArchiveLimitExceeded, x.maxentries)
+	}
+
+	return nil
+}
+
+// entrypath validates an entry name, and returns it cleaned and in slash
+// form.
+func entrypath(name string) (string, error) {
+	cleaned := path.Clean(strings.ReplaceAll(name, "\\", "/"))
+	if path.IsAbs(cleaned) || filepath.VolumeName(filepath.FromSlash(cleaned)) != "" {
+		return "", &UnsafeArchiveEntryError{Name: name, Reason: "absolute path"}
+	}
+	if cleaned == ".." || strings.HasPrefix(cleaned, "../") {
+		return "", &UnsafeArchiveEntryError{Name: name, Reason: "path leads outside the destination"}
+	}
+
+	return cleaned, nil
+}
+
+// target counts an entry, validates its name, and returns its full path
+// under the destination directory. It refuses entries that would be
+// written through an existing symbolic link.
+func (x *extractor) target(name string) (string, error) {
+	if err := x.addentry(); err != nil {
+		return "", err
+	}
+
+	return x.resolve(name)
+}
+
+// resolve validates an entry name, and returns its full path under the
+// destination directory. It refuses paths that pass through an existing
+// symbolic link.
+func (x *extractor) resolve(name string) (string, error) {
+	cleaned, err := entrypath(name)
+	if err != nil {
+		return "", err
+	}
+
+	current := x.destdir
+	components := strings.Split(cleaned, "/")
+	for _, component := range components[:len(components)-1] {
+		current = filepath.Join(current, component)
+		fileinfo, err := os.Lstat(current)
+		if os.IsNotExist(err) {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if fileinfo.Mode()&fs.ModeSymlink != 0 {
+			return "", &UnsafeArchiveEntryError{Name: name, Reason: "path passes through a symbolic link"}
+		}
+	}
+
+	return filepath.Join(x.destdir, filepath.FromSlash(cleaned)), nil
+}
+
+// removeexisting removes an existing file, but not directory, at a path.
+func removeexisting(targetpath string) error {
+	fileinfo, err := os.Lstat(targetpath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if fileinfo.IsDir() {
+		return fmt.Errorf("%s is an existing directory", targetpath)
+	}
+
+	return os.Remove(targetpath)
+}
+
+func (x *extractor) mkdir(name string, mode fs.FileMode) error {
+	targetpath, err := x.target(name)
+	if err != nil {
+		return err
+	}
+
+	if fileinfo, err := os.Lstat(targetpath); err == nil && fileinfo.Mode()&fs.ModeSymlink != 0 {
+		return &UnsafeArchiveEntryError{Name: name, Reason: "directory replaces a symbolic link"}
+	}
+
+	perm := mode.Perm() | 0700
+	if err := os.MkdirAll(targetpath, perm); err != nil {
+		return err
+	}
+
+	return os.Chmod(targetpath, perm)
+}
+
+func (x *extractor) writefile(name string, mode fs.FileMode, source io.Reader) error {
+	targetpath, err := x.target(name)
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(targetpath), 0755); err != nil {
+		return err
+	}
+	if err := removeexisting(targetpath); err != nil {
+		return err
+	}
+
+	perm := mode.Perm()
+	if perm == 0 {
+		perm = 0644
+	}
+	out, err := os.OpenFile(targetpath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, perm)
+	if err != nil {
+		return err
+	}
+
+	err = x.copy(out, source)
+	if closeerr := out.Close(); err == nil {
+		err = closeerr
+	}
+	if err != nil {
+		return err
+	}
+
+	return os.Chmod(targetpath, perm)
+}
+
+// copy copies file data, enforcing the size limit and reporting progress.
+func (x *extractor) copy(out io.Writer, source io.Reader) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := source.Read(buf)
+		if n > 0 {
+			x.written += int64(n)
+			if x.maxsize > 0 && x.written > x.maxsize {
+				return fmt.Errorf("%w: more than %v bytes", ErrArchiveLimitExceeded, x.maxsize)
+			}
+			if _, err := out.Write(buf[:n]); err != nil {
+				return err
+			}
+			if x.progress != nil {
+				x.progress(x.written, x.total)
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (x *extractor) symlink(name string, linkname string) error {
+	targetpath, err := x.target(name)
+	if err != nil {
+		return err
+	}
+
+	cleaned, _ := entrypath(name)
+	slashlink := strings.ReplaceAll(linkname, "\\", "/")
+	if path.IsAbs(slashlink) || filepath.IsAbs(linkname) {
+		return &UnsafeArchiveEntryError{Name: name, Reason: "symbolic link to an absolute path"}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(targetpath), 0755); err != nil {
+		return err
+	}
+	if reason := x.linkescape(path.Dir(cleaned), slashlink); reason != "" {
+		return &UnsafeArchiveEntryError{Name: name, Reason: reason}
+	}
+	if err := removeexisting(targetpath); err != nil {
+		return err
+	}
+
+	return os.Symlink(linkname, targetpath)
+}
+
+// linkescape returns why a symbolic link in dir, pointing to linkname,
+// might lead outside the destination, or "" if it cannot. The target may
+// not pass through an existing symbolic link, and may only go up from an
+// existing directory, since a later entry could make anything else a link.
+func (x *extractor) linkescape(dir string, linkname string) string {
+	var components []string
+	for _, component := range strings.Split(dir+"/"+linkname, "/") {
+		if component != "" && component != "." {
+			components = append(components, component)
+		}
+	}
+
+	var resolved []string
+	for i, component := range components {
+		current := filepath.Join(x.destdir, filepath.FromSlash(path.Join(resolved...)))
+		if component == ".." {
+			if len(resolved) == 0 {
+				return "symbolic link leads outside the destination"
+			}
+			fileinfo, err := os.Lstat(current)
+			if err != nil || !fileinfo.IsDir() {
+				return "symbolic link goes up from a path that is not a directory"
+			}
+			resolved = resolved[:len(resolved)-1]
+			continue
+		}
+
+		resolved = append(resolved, component)
+		if i == len(components)-1 {
+			break
+		}
+		fileinfo, err := os.Lstat(filepath.Join(current, component))
+		if err == nil && fileinfo.Mode()&fs.ModeSymlink != 0 {
+			return "symbolic link passes through a symbolic link"
+		}
+	}
+
+	return ""
+}
+
+func (x *extractor) hardlink(name string, linkname string) error {
+	targetpath, err := x.target(name)
+	if err != nil {
+		return err
+	}
+
+	linkpath, err := x.resolve(linkname)
+	if err != nil {
+		return err
+	}
+	linkinfo, err := os.Lstat(linkpath)
+	if err != nil {
+		return err
+	}
+	if !linkinfo.Mode().IsRegular() {
+		return &UnsafeArchiveEntryError{Name: name, Reason: "hard link to a file that is not regular"}
+	}
+
+	if err := os.MkdirAll(filepath.Dir(targetpath), 0755); err != nil {
+		return err
+	}
+	if err := removeexisting(targetpath); err != nil {
+		return err
+	}
+
+	return os.Link(linkpath, targetpath)
+}
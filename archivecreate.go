@@ -0,0 +1,324 @@
+package workspace
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kuttiproject/kuttilog"
+)
+
+// DefaultArchiveModTime is the modification time recorded for all entries
+// by CreateArchive, unless another is specified.
+var DefaultArchiveModTime = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// CreateArchiveOptions control the behaviour of CreateArchive.
+type CreateArchiveOptions struct {
+	// Format is "tar" or "zip". If empty, "tar" is used.
+	Format string
+	// Compression is the registered compression format of a tar archive,
+	// such as "gzip". If empty, the archive is not compressed.
+	Compression string
+	// Include, if not empty, limits the archive to files matching at least
+	// one of these patterns.
+	Include []string
+	// Exclude leaves out files and directories matching any of these
+	// patterns.
+	Exclude []string
+	// ModTime is recorded as the modification time of all entries. If
+	// zero, DefaultArchiveModTime is used.
+	ModTime time.Time
+	// Progress, if not nil, is called as files are added. It reports bytes
+	// of files read so far, and their total size.
+	Progress ProgressFunc
+}
+
+// archiveentry is a file, directory or symbolic link to be archived.
+type archiveentry struct {
+	name     string
+	fullpath string
+	mode     fs.FileMode
+	size     int64
+	linkname string
+}
+
+// CreateArchive packs the contents of a directory into a tar or zip archive,
+// written to w. The directory itself is not included, only its contents.
+// Symbolic links are stored as links, and other special files are skipped.
+//
+// Patterns in the options use the syntax of path.Match. A pattern containing
+// a slash is matched against the slash-separated path relative to srcdir,
+// and other patterns against the base name.
+//
+// The output is deterministic: entries are sorted by path, and recorded with
+// a fixed modification time and no owner. Archiving the same contents twice
+// produces identical bytes, so that the ChecksumFile of an archive can be
+// recorded and checked later.
+func CreateArchive(srcdir string, w io.Writer, options *CreateArchiveOptions) error {
+	createoptions := CreateArchiveOptions{}
+	if options != nil {
+		createoptions = *options
+	}
+	if createoptions.Format == "" {
+		createoptions.Format = "tar"
+	}
+	if createoptions.ModTime.IsZero() {
+		createoptions.ModTime = DefaultArchiveModTime
+	}
+	if createoptions.Format != "tar" && createoptions.Format != "zip" {
+		return fmt.Errorf("unsupported archive format %s", createoptions.Format)
+	}
+
+	compressor, err := findcompressor(createoptions.Compression)
+	if err != nil {
+		return err
+	}
+	if compressor != nil && createoptions.Format != "tar" {
+		return fmt.Errorf("compression is only supported for tar archives")
+	}
+
+	entries, total, err := archiveentries(srcdir, createoptions.Include, createoptions.Exclude)
+	if err != nil {
+		return err
+	}
+
+	kuttilog.Printf(kuttilog.Debug, "Archiving %v entries from %s...", len(entries), srcdir)
+
+	aggregate := &aggregateprogress{callback: createoptions.Progress, total: total}
+	if createoptions.Format == "zip" {
+		return writezip(w, entries, createoptions.ModTime, aggregate)
+	}
+
+	if compressor == nil {
+		return writetar(w, entries, createoptions.ModTime, aggregate)
+	}
+
+	cw, err := compressor(w)
+	if err != nil {
+		return err
+	}
+	err = writetar(cw, entries, createoptions.ModTime, aggregate)
+	if closeerr := cw.Close(); err == nil {
+		err = closeerr
+	}
+	return err
+}
+
+// archivematch reports whether a relative path matches any of the patterns.
+func archivematch(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		subject := path.Base(name)
+		if strings.Contains(pattern, "/") {
+			subject = name
+		}
+		if matched, _ := path.Match(pattern, subject); matched {
+			return true
+		}
+	}
+
+	return false
+}
+
+// archiveentries returns the sorted entries to be archived from a
+// directory, and the total size of the regular files among them.
+// Directories are included if they contain included entries.
+func archiveentries(srcdir string, include []string, exclude []string) ([]*archiveentry, int64, error) {
+	srcinfo, err := os.Stat(srcdir)
+	if err != nil {
+		return nil, 0, err
+	}
+	if !srcinfo.IsDir() {
+		return nil, 0, fmt.Errorf("%s is not a directory", srcdir)
+	}
+
+	var (
+		entries []*archiveentry
+		dirs    = map[string]*archiveentry{}
+		total   int64
+	)
+	err = filepath.WalkDir(srcdir, func(fullpath string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if fullpath == srcdir {
+			return nil
+		}
+
+		relpath, err := filepath.Rel(srcdir, fullpath)
+		if err != nil {
+			return err
+		}
+		name := filepath.ToSlash(relpath)
+
+		if archivematch(name, exclude) {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		entry := &archiveentry{name: name, fullpath: fullpath, mode: info.Mode()}
+
+		if d.IsDir() {
+			dirs[name] = entry
+			return nil
+		}
+		if len(include) > 0 && !archivematch(name, include) {
+			return nil
+		}
+
+		switch {
+		case info.Mode().IsRegular():
+			entry.size = info.Size()
+			total += entry.size
+		case info.Mode()&fs.ModeSymlink != 0:
+			entry.linkname, err = os.Readlink(fullpath)
+			if err != nil {
+				return err
+			}
+		default:
+			kuttilog.Printf(kuttilog.Debug, "Skipping special file %s.", fullpath)
+			return nil
+		}
+
+		entries = append(entries, entry)
+		return nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// Add the directories containing included entries.
+	needed := map[string]bool{}
+	for _, entry := range entries {
+		for dir := path.Dir(entry.name); dir != "."; dir = path.Dir(dir) {
+			needed[dir] = true
+		}
+	}
+	if len(include) == 0 {
+		for name := range dirs {
+			needed[name] = true
+		}
+	}
+	for name := range needed {
+		entries = append(entries, dirs[name])
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].name < entries[j].name
+	})
+
+	return entries, total, nil
+}
+
+func writetar(w io.Writer, entries []*archiveentry, modtime time.Time, aggregate *aggregateprogress) error {
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		header := &tar.Header{
+			Name:    entry.name,
+			Mode:    int64(entry.mode.Perm()),
+			ModTime: modtime,
+		}
+		switch {
+		case entry.mode.IsDir():
+			header.Typeflag = tar.TypeDir
+			header.Name += "/"
+		case entry.mode&fs.ModeSymlink != 0:
+			header.Typeflag = tar.TypeSymlink
+			header.Linkname = entry.linkname
+		default:
+			header.Typeflag = tar.TypeReg
+			header.Size = entry.size
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeReg {
+			if err := copyarchivefile(tw, entry, aggregate); err != nil {
+				return err
+			}
+		}
+	}
+
+	return tw.Close()
+}
+
+func writezip(w io.Writer, entries []*archiveentry, modtime time.Time, aggregate *aggregateprogress) error {
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		header := &zip.FileHeader{
+			Name:     entry.name,
+			Method:   zip.Deflate,
+			Modified: modtime,
+		}
+		switch {
+		case entry.mode.IsDir():
+			header.Name += "/"
+			header.Method = zip.Store
+			header.SetMode(fs.ModeDir | entry.mode.Perm())
+		case entry.mode&fs.ModeSymlink != 0:
+			header.SetMode(fs.ModeSymlink | 0777)
+		default:
+			header.SetMode(entry.mode.Perm())
+		}
+
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		switch {
+		case entry.mode.IsDir():
+		case entry.mode&fs.ModeSymlink != 0:
+			if _, err := io.WriteString(fw, entry.linkname); err != nil {
+				return err
+			}
+		default:
+			if err := copyarchivefile(fw, entry, aggregate); err != nil {
+				return err
+			}
+		}
+	}
+
+	return zw.Close()
+}
+
+// copyarchivefile copies the contents of a file into an archive, reporting
+// progress. It fails if the file has changed size since it was listed.
+func copyarchivefile(w io.Writer, entry *archiveentry, aggregate *aggregateprogress) error {
+	f, err := os.Open(entry.fullpath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	previous := int64(0)
+	reader := &progressreader{
+		Reader: f,
+		callback: func(current int64, total int64) {
+			aggregate.add(current - previous)
+			previous = current
+		},
+	}
+	n, err := io.Copy(w, io.LimitReader(reader, entry.size))
+	if err != nil {
+		return err
+	}
+	if n != entry.size {
+		return fmt.Errorf("%s changed size while being archived", entry.fullpath)
+	}
+
+	return nil
+}
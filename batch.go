@@ -0,0 +1,312 @@
+package workspace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/kuttiproject/kuttilog"
+)
+
+// ErrBatchIncomplete is returned, wrapped, when required items of a batch
+// could not be downloaded.
+var ErrBatchIncomplete = errors.New("batch download incomplete")
+
+// BatchItem is a file to be downloaded as part of a batch.
+type BatchItem struct {
+	// URL is the source of the file.
+	URL string `json:"url"`
+	// Destination is the path to save the file to. Relative paths are
+	// relative to the batch's base directory.
+	Destination string `json:"destination"`
+	// Checksum, if not empty, is the expected digest of the file, in the
+	// form accepted by ParseDigest.
+	Checksum string `json:"checksum,omitempty"`
+	// Signature, if not empty, is the URL or local path of a minisign
+	// signature for the file, as for the Signature download option.
+	Signature string `json:"signature,omitempty"`
+	// Optional items do not cause the batch to fail if they cannot be
+	// downloaded.
+	Optional bool `json:"optional,omitempty"`
+}
+
+// BatchManifest lists the files to be downloaded by DownloadBatch. It can
+// be stored as JSON.
+type BatchManifest struct {
+	Items []BatchItem `json:"items"`
+}
+
+// LoadBatchManifest reads a batch manifest from a JSON file.
+func LoadBatchManifest(path string) (*BatchManifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &BatchManifest{}
+	if err := json.Unmarshal(data, manifest); err != nil {
+		return nil, fmt.Errorf("invalid batch manifest %s: %v", path, err)
+	}
+
+	return manifest, nil
+}
+
+// BatchItemStatus is the outcome of downloading a batch item.
+type BatchItemStatus string
+
+const (
+	// BatchItemPending means the item was not attempted, because the batch
+	// was cancelled.
+	BatchItemPending BatchItemStatus = "pending"
+	// BatchItemDone means the item was downloaded.
+	BatchItemDone BatchItemStatus = "done"
+	// BatchItemSkipped means the item had been downloaded by an earlier
+	// run of the batch.
+	BatchItemSkipped BatchItemStatus = "skipped"
+	// BatchItemFailed means the item could not be downloaded.
+	BatchItemFailed BatchItemStatus = "failed"
+)
+
+// BatchItemResult reports the outcome of downloading a batch item.
+type BatchItemResult struct {
+	Item   BatchItem       `json:"item"`
+	Status BatchItemStatus `json:"status"`
+	// Error describes why the item failed, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+// BatchResult reports the outcome of DownloadBatch.
+type BatchResult struct {
+	// Items are the results, in manifest order.
+	Items []BatchItemResult `json:"items"`
+	// Failed is the number of items that failed, including optional ones.
+	Failed int `json:"failed"`
+}
+
+// BatchOptions control the behaviour of DownloadBatch.
+type BatchOptions struct {
+	// Concurrency is the number of files downloaded at a time. If 0, 4 is
+	// used.
+	Concurrency int
+	// BaseDir is the directory relative destinations are resolved against.
+	// If empty, the current directory is used.
+	BaseDir string
+	// StatePath, if not empty, is a file in which the batch's progress is
+	// saved. Items recorded as done are skipped when the batch is run
+	// again, and partially downloaded files are kept and resumed.
+	StatePath string
+	// Progress, if not nil, is called as files are downloaded. It reports
+	// bytes downloaded so far across all files, and the total size of the
+	// files whose sizes are known so far.
+	Progress ProgressFunc
+	// Download, if not nil, holds options applied to each download, such
+	// as a retry policy or rate limit. Its Progress, Checksum and Signature
+	// are ignored, since each item has its own.
+	Download *DownloadOptions
+}
+
+// batchstate records completed items, keyed by destination.
+type batchstate struct {
+	Done map[string]BatchItem `json:"done"`
+}
+
+// DownloadBatch downloads the files in a manifest using the default
+// Downloader. The options parameter can be nil.
+func DownloadBatch(ctx context.Context, manifest *BatchManifest, options *BatchOptions) (*BatchResult, error) {
+	return DefaultDownloader().DownloadBatch(ctx, manifest, options)
+}
+
+// DownloadBatch downloads the files in a manifest, several at a time. All
+// items are attempted, even if some fail. The result reports the outcome of
+// each item. If any required item fails, the returned error wraps
+// ErrBatchIncomplete. If the context is cancelled, items not yet started
+// are left pending. The options parameter can be nil.
+func (d *Downloader) DownloadBatch(ctx context.Context, manifest *BatchManifest, options *BatchOptions) (*BatchResult, error) {
+	if options == nil {
+		options = &BatchOptions{}
+	}
+
+	concurrency := options.Concurrency
+	if concurrency <= 0 {
+		concurrency = 4
+	}
+
+	checksums := make([]Digest, len(manifest.Items))
+	for i, item := range manifest.Items {
+		if item.Checksum == "" {
+			continue
+		}
+		digest, err := ParseDigest(item.Checksum)
+		if err != nil {
+			return nil, fmt.Errorf("batch item %s: %w", item.URL, err)
+		}
+		checksums[i] = digest
+	}
+
+	state := &batchstate{Done: map[string]BatchItem{}}
+	if options.StatePath != "" {
+		if data, err := os.ReadFile(options.StatePath); err == nil {
+			if err := json.Unmarshal(data, state); err != nil || state.Done == nil {
+				kuttilog.Printf(kuttilog.Debug, "Ignoring invalid batch state %s.", options.StatePath)
+				state = &batchstate{Done: map[string]BatchItem{}}
+			}
+		}
+	}
+
+	result := &BatchResult{Items: make([]BatchItemResult, len(manifest.Items))}
+	for index, item := range manifest.Items {
+		result.Items[index] = BatchItemResult{Item: item, Status: BatchItemPending}
+	}
+	progress := newbatchprogress(len(manifest.Items), options.Progress)
+
+	var (
+		wg      sync.WaitGroup
+		statemu sync.Mutex
+		work    = make(chan int)
+	)
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for index := range work {
+				item := manifest.Items[index]
+				destpath := item.Destination
+				if !filepath.IsAbs(destpath) && options.BaseDir != "" {
+					destpath = filepath.Join(options.BaseDir, destpath)
+				}
+
+				itemresult := &result.Items[index]
+
+				statemu.Lock()
+				done, ok := state.Done[destpath]
+				statemu.Unlock()
+				if ok && done == item {
+					if _, err := os.Stat(destpath); err == nil {
+						kuttilog.Printf(kuttilog.Debug, "Batch item %s already downloaded.", item.URL)
+						itemresult.Status = BatchItemSkipped
+						continue
+					}
+				}
+
+				downloadoptions := DownloadOptions{}
+				if options.Download != nil {
+					downloadoptions = *options.Download
+				}
+				downloadoptions.Checksum = checksums[index]
+				downloadoptions.Signature = item.Signature
+				downloadoptions.Progress = progress.item(index)
+				if options.StatePath != "" {
+					downloadoptions.Resume = true
+				}
+
+				err := d.DownloadFileContext(ctx, item.URL, destpath, &downloadoptions)
+				if err != nil {
+					kuttilog.Printf(kuttilog.Verbose, "Batch item %s failed: %v", item.URL, err)
+					itemresult.Status = BatchItemFailed
+					itemresult.Error = err.Error()
+					continue
+				}
+				itemresult.Status = BatchItemDone
+
+				if options.StatePath != "" {
+					statemu.Lock()
+					state.Done[destpath] = item
+					err = savebatchstate(options.StatePath, state)
+					statemu.Unlock()
+					if err != nil {
+						kuttilog.Printf(kuttilog.Info, "Could not save batch state: %v", err)
+					}
+				}
+			}
+		}()
+	}
+
+feed:
+	for index := range manifest.Items {
+		select {
+		case work <- index:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	requiredfailed := 0
+	for _, itemresult := range result.Items {
+		if itemresult.Status == BatchItemFailed {
+			result.Failed++
+			if !itemresult.Item.Optional {
+				requiredfailed++
+			}
+		}
+		if itemresult.Status == BatchItemPending {
+			requiredfailed++
+		}
+	}
+
+	if requiredfailed > 0 {
+		return result, fmt.Errorf("%w: %v of %v items not downloaded", ErrBatchIncomplete, requiredfailed, len(manifest.Items))
+	}
+
+	return result, nil
+}
+
+func savebatchstate(statepath string, state *batchstate) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	tmppath := statepath + ".tmp"
+	if err := os.WriteFile(tmppath, data, 0644); err != nil {
+		return err
+	}
+
+	return os.Rename(tmppath, statepath)
+}
+
+// batchprogress combines the progress of the items in a batch.
+type batchprogress struct {
+	mu       sync.Mutex
+	current  []int64
+	total    []int64
+	callback ProgressFunc
+}
+
+func newbatchprogress(items int, callback ProgressFunc) *batchprogress {
+	return &batchprogress{
+		current:  make([]int64, items),
+		total:    make([]int64, items),
+		callback: callback,
+	}
+}
+
+// item returns a ProgressFunc for an item, or nil if progress is not
+// being reported.
+func (bp *batchprogress) item(index int) ProgressFunc {
+	if bp.callback == nil {
+		return nil
+	}
+
+	return func(current int64, total int64) {
+		bp.mu.Lock()
+		defer bp.mu.Unlock()
+
+		bp.current[index] = current
+		if total > 0 {
+			bp.total[index] = total
+		}
+
+		var sumcurrent, sumtotal int64
+		for i := range bp.current {
+			sumcurrent += bp.current[i]
+			sumtotal += bp.total[i]
+		}
+		bp.callback(sumcurrent, sumtotal)
+	}
+}
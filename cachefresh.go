@@ -0,0 +1,200 @@
+package workspace
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/kuttiproject/kuttilog"
+)
+
+// SetCacheEntryTTL sets the cache entry with the specified key to go stale
+// after the specified duration from now. A duration of 0 means that the
+// entry never goes stale.
+func SetCacheEntryTTL(key string, ttl time.Duration) error {
+	return updatecacheindex(func(cachedir string, index *cacheindex) error {
+		entry, ok := index.Entries[key]
+		if !ok {
+			return ErrCacheEntryNotFound
+		}
+
+		entry.Expires = expirytime(ttl)
+		return nil
+	})
+}
+
+func expirytime(ttl time.Duration) time.Time {
+	if ttl <= 0 {
+		return time.Time{}
+	}
+
+	return time.Now().UTC().Add(ttl)
+}
+
+// FetchCacheEntry returns a fresh cache entry for a file fetched from the
+// specified URL. The path can be absolute, or relative to the cache directory.
+//
+// If the cache entry with the specified key exists, has not gone stale and
+// its file is present, it is returned as is. Otherwise, the file is fetched
+// from the URL. If the entry was fetched over HTTP before, the fetch is a
+// conditional request using the recorded ETag and Last-Modified values, and
+// the file is only downloaded again if it has changed. Either way, the entry
+// will go stale after the specified ttl. A ttl of 0 means never. Validators
+// returned with a 304 response replace the recorded ones.
+//
+// Files are fetched using DownloadFileContext, so fetches are retried
+// according to the retry policy, and coordinated with other downloads to the
+// same path.
+func FetchCacheEntry(key string, url string, path string, ttl time.Duration, labels ...string) (*CacheEntry, error) {
+	if key == "" {
+		return nil, errors.New("cache entry key must not be empty")
+	}
+
+	var (
+		cached   *CacheEntry
+		relpath  string
+		fullpath string
+	)
+	err := readcacheindex(func(cachedir string, index *cacheindex) error {
+		var err error
+		relpath, err = cacherelativepath(cachedir, path)
+		if err != nil {
+			return err
+		}
+		fullpath = filepath.Join(cachedir, filepath.FromSlash(relpath))
+
+		entry, ok := index.Entries[key]
+		if ok && entry.Path == relpath && entry.SourceURL == url {
+			if _, err := os.Stat(fullpath); err == nil {
+				cached = entry.clone()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if cached != nil && !cached.Expired() {
+		kuttilog.Printf(
+			kuttilog.Debug,
+			"Cache entry '%s' is fresh.",
+			key,
+		)
+		return GetCacheEntry(key)
+	}
+
+	if Offline() && cached != nil {
+		if _, ok := findinmirrors(url); !ok {
+			kuttilog.Printf(kuttilog.Verbose, "Offline mode: using stale cache entry '%s'.", key)
+			return GetCacheEntry(key)
+		}
+	}
+
+	revalidation := &revalidation{}
+	if cached != nil {
+		revalidation.cached = downloadstate{URL: url, ETag: cached.ETag, LastModified: cached.LastModified}
+	}
+
+	kuttilog.Printf(kuttilog.Debug, "Revalidating cache entry '%s' from %s...", key, url)
+	fetched := true
+	err = DownloadFileContext(context.Background(), url, fullpath, &DownloadOptions{revalidation: revalidation})
+	if errors.Is(err, errnotmodified) {
+		kuttilog.Printf(kuttilog.Verbose, "%s has not changed at source.", url)
+		fetched = false
+		err = nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	etag, lastmodified := revalidation.received.ETag, revalidation.received.LastModified
+
+	var result *CacheEntry
+	err = updatecacheindex(func(cachedir string, index *cacheindex) error {
+		if fetched {
+			index.Misses++
+		} else {
+			index.Hits++
+		}
+
+		entry := index.Entries[key]
+		if fetched || entry == nil {
+			var err error
+			entry, err = recordcacheentry(cachedir, index, key, relpath, labels)
+			if err != nil {
+				return err
+			}
+
+			entry.SourceURL = url
+			entry.ETag = etag
+			entry.LastModified = lastmodified
+		} else {
+			// A 304 response may carry updated validators.
+			if etag != "" {
+				entry.ETag = etag
+			}
+			if lastmodified != "" {
+				entry.LastModified = lastmodified
+			}
+		}
+
+		entry.Expires = expirytime(ttl)
+		entry.LastUsed = time.Now().UTC()
+		result = entry.clone()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// errnotmodified is returned by a conditional download if the file has not
+// changed at the source.
+var errnotmodified = errors.New("not modified")
+
+// revalidation holds the validators of a cached file, which make a download
+// conditional, and receives the validators returned by the server.
+type revalidation struct {
+	cached   downloadstate
+	received downloadstate
+}
+
+// conditional reports whether a download is conditional. It is false on a
+// nil revalidation.
+func (rv *revalidation) conditional() bool {
+	return rv != nil && (rv.cached.ETag != "" || rv.cached.LastModified != "")
+}
+
+// addconditions makes a request conditional on the file having changed. It
+// does nothing on a nil revalidation.
+func (rv *revalidation) addconditions(req *http.Request) {
+	if rv == nil {
+		return
+	}
+
+	if rv.cached.ETag != "" {
+		req.Header.Set("If-None-Match", rv.cached.ETag)
+	}
+	if rv.cached.LastModified != "" {
+		req.Header.Set("If-Modified-Since", rv.cached.LastModified)
+	}
+}
+
+// record saves the validators of a response. It does nothing on a nil
+// revalidation.
+func (rv *revalidation) record(resp *http.Response) {
+	if rv == nil {
+		return
+	}
+
+	rv.received = downloadstate{
+		URL:          rv.cached.URL,
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+}
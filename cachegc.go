@@ -0,0 +1,219 @@
+package workspace
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/kuttiproject/kuttilog"
+)
+
+// Pin marks the cache entry with the specified key as in use by the named
+// owner. Pinned entries are never removed by GC or RemoveCacheEntry.
+// Pinning an entry again with the same owner has no effect.
+func Pin(key string, owner string) error {
+	if owner == "" {
+		return errors.New("owner must not be empty")
+	}
+
+	return updatecacheindex(func(cachedir string, index *cacheindex) error {
+		entry, ok := index.Entries[key]
+		if !ok {
+			return ErrCacheEntryNotFound
+		}
+
+		for _, existingowner := range entry.Owners {
+			if existingowner == owner {
+				return nil
+			}
+		}
+
+		entry.Owners = append(entry.Owners, owner)
+		sort.Strings(entry.Owners)
+		return nil
+	})
+}
+
+// Unpin removes the named owner's pin from the cache entry with the
+// specified key. Unpinning an entry not pinned by the owner has no effect.
+func Unpin(key string, owner string) error {
+	return updatecacheindex(func(cachedir string, index *cacheindex) error {
+		entry, ok := index.Entries[key]
+		if !ok {
+			return ErrCacheEntryNotFound
+		}
+
+		owners := entry.Owners[:0]
+		for _, existingowner := range entry.Owners {
+			if existingowner != owner {
+				owners = append(owners, existingowner)
+			}
+		}
+		entry.Owners = owners
+		return nil
+	})
+}
+
+// GCOptions control the behaviour of GC.
+type GCOptions struct {
+	// DryRun reports what would be removed, without removing anything.
+	DryRun bool
+	// UnusedFor, if non-zero, spares unpinned entries that have been used
+	// within the specified duration.
+	UnusedFor time.Duration
+	// RemoveOrphans also removes files under the cache directory that are
+	// not recorded in the cache index.
+	RemoveOrphans bool
+}
+
+// GCResult reports what GC removed, or would have removed in a dry run.
+type GCResult struct {
+	// DryRun is true if nothing was actually removed.
+	DryRun bool `json:"dryrun"`
+	// Entries are the keys of removed cache entries.
+	Entries []string `json:"entries"`
+	// Orphans are the paths, relative to the cache directory, of removed
+	// files that were not recorded in the cache index.
+	Orphans []string `json:"orphans"`
+	// Freed is the number of bytes freed.
+	Freed int64 `json:"freed"`
+}
+
+// GC removes unpinned cache entries that are not in use, and entries whose
+// files no longer exist. Optionally, it also removes orphaned files, i.e.
+// files under the cache directory that are not recorded in the cache index.
+// Temporary and lock files of downloads and copies in progress are not
+// treated as orphans. If some files cannot be removed, GC carries on with
+// the rest, saves the index, and returns the result along with the errors.
+func GC(options GCOptions) (*GCResult, error) {
+	result := &GCResult{DryRun: options.DryRun}
+	var removeerrs []error
+
+	err := updatecacheindex(func(cachedir string, index *cacheindex) error {
+		now := time.Now().UTC()
+
+		for key, entry := range index.Entries {
+			fullpath := filepath.Join(cachedir, filepath.FromSlash(entry.Path))
+			fileinfo, err := os.Stat(fullpath)
+			if os.IsNotExist(err) {
+				kuttilog.Printf(
+					kuttilog.Verbose,
+					"Cache entry '%s' has no file. Removing from index.",
+					key,
+				)
+				result.Entries = append(result.Entries, key)
+				if !options.DryRun {
+					delete(index.Entries, key)
+				}
+				continue
+			}
+			if err != nil {
+				return err
+			}
+
+			if entry.Pinned() ||
+				(options.UnusedFor > 0 && now.Sub(entry.LastUsed) < options.UnusedFor) {
+				continue
+			}
+
+			kuttilog.Printf(
+				kuttilog.Verbose,
+				"Removing unpinned cache entry '%s' (%s).",
+				key,
+				entry.Path,
+			)
+			if !options.DryRun {
+				if err := os.Remove(fullpath); err != nil {
+					removeerrs = append(removeerrs, err)
+					continue
+				}
+				delete(index.Entries, key)
+			}
+			result.Entries = append(result.Entries, key)
+			result.Freed += fileinfo.Size()
+		}
+
+		if !options.RemoveOrphans {
+			return nil
+		}
+
+		// In a dry run, entries slated for removal are still in the index,
+		// and their files should not also be reported as orphans.
+		indexed := map[string]bool{}
+		for _, entry := range index.Entries {
+			indexed[entry.Path] = true
+		}
+
+		return filepath.WalkDir(cachedir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() || inprogressfile(d.Name()) {
+				return nil
+			}
+
+			relpath, err := filepath.Rel(cachedir, path)
+			if err != nil {
+				return err
+			}
+			relpath = filepath.ToSlash(relpath)
+			if relpath == cacheindexfilename || indexed[relpath] {
+				return nil
+			}
+
+			fileinfo, err := d.Info()
+			if err != nil {
+				return err
+			}
+
+			kuttilog.Printf(
+				kuttilog.Verbose,
+				"Removing orphaned cache file %s.",
+				relpath,
+			)
+			if !options.DryRun {
+				if err := os.Remove(path); err != nil {
+					removeerrs = append(removeerrs, err)
+					return nil
+				}
+			}
+			result.Orphans = append(result.Orphans, relpath)
+			result.Freed += fileinfo.Size()
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Strings(result.Entries)
+	sort.Strings(result.Orphans)
+	return result, errors.Join(removeerrs...)
+}
+
+// inprogressfilesuffixes are the suffixes of temporary and lock files
+// written by downloads, copies and the cache index while they are in
+// progress.
+var inprogressfilesuffixes = []string{
+	".download",
+	".download.json",
+	".lock",
+	".copy",
+	".tmp",
+}
+
+// inprogressfile reports whether a file name is that of a temporary or lock
+// file, which GC must not remove as an orphan.
+func inprogressfile(name string) bool {
+	for _, suffix := range inprogressfilesuffixes {
+		if strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+
+	return false
+}
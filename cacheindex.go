@@ -0,0 +1,368 @@
+package workspace
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kuttiproject/kuttilog"
+)
+
+const cacheindexfilename = "cacheindex.json"
+
+// ErrCacheEntryNotFound is returned when a key is not present in the cache index.
+var ErrCacheEntryNotFound = errors.New("cache entry not found")
+
+// CacheEntry describes a file stored under the cache directory, as recorded
+// in the cache index.
+type CacheEntry struct {
+	// Key uniquely identifies the entry.
+	Key string `json:"key"`
+	// Path is the location of the file, relative to the cache directory.
+	Path string `json:"path"`
+	// Size is the size of the file in bytes, when it was added.
+	Size int64 `json:"size"`
+	// Checksum is the SHA256 checksum of the file, when it was added.
+	Checksum string `json:"checksum,omitempty"`
+	// Labels are arbitrary tags used to group entries.
+	Labels []string `json:"labels,omitempty"`
+	// Owners are the names of owners who have pinned the entry.
+	Owners []string `json:"owners,omitempty"`
+	// SourceURL is the URL the file was fetched from, if any.
+	SourceURL string `json:"sourceurl,omitempty"`
+	// ETag is the HTTP ETag of the file, if it was fetched over HTTP.
+	ETag string `json:"etag,omitempty"`
+	// LastModified is the HTTP Last-Modified value of the file, if it was
+	// fetched over HTTP.
+	LastModified string `json:"lastmodified,omitempty"`
+	// Expires is the time after which the entry is considered stale. A zero
+	// value means that the entry never goes stale.
+	Expires time.Time `json:"expires,omitempty"`
+	// Created is the time when the entry was first added.
+	Created time.Time `json:"created"`
+	// LastUsed is the time when the entry was last added or looked up.
+	LastUsed time.Time `json:"lastused"`
+}
+
+// Pinned returns true if at least one owner has pinned the entry.
+func (ce *CacheEntry) Pinned() bool {
+	return len(ce.Owners) > 0
+}
+
+// Expired returns true if the entry has an expiry time, and it has passed.
+func (ce *CacheEntry) Expired() bool {
+	return !ce.Expires.IsZero() && time.Now().After(ce.Expires)
+}
+
+// FullPath returns the full path of the entry's file, under the
+// current cache directory.
+func (ce *CacheEntry) FullPath() (string, error) {
+	cachedir, err := CacheDir()
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(cachedir, filepath.FromSlash(ce.Path)), nil
+}
+
+func (ce *CacheEntry) clone() *CacheEntry {
+	result := *ce
+	result.Labels = append([]string(nil), ce.Labels...)
+	result.Owners = append([]string(nil), ce.Owners...)
+	return &result
+}
+
+type cacheindex struct {
+	Entries map[string]*CacheEntry `json:"entries"`
+	Hits    int64                  `json:"hits"`
+	Misses  int64                  `json:"misses"`
+}
+
+// cacheindexlock serializes access to the cache index within this process.
+// Updates are serialized across processes by a lock file as well.
+var cacheindexlock sync.Mutex
+
+func loadcacheindex(cachedir string) (*cacheindex, error) {
+	result := &cacheindex{Entries: map[string]*CacheEntry{}}
+
+	data, err := os.ReadFile(filepath.Join(cachedir, cacheindexfilename))
+	if os.IsNotExist(err) {
+		return result, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	err = json.Unmarshal(data, result)
+	if err != nil {
+		return nil, fmt.Errorf("cache index is corrupt: %v", err)
+	}
+	if result.Entries == nil {
+		result.Entries = map[string]*CacheEntry{}
+	}
+
+	return result, nil
+}
+
+func savecacheindex(cachedir string, index *cacheindex) error {
+	data, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// The temporary file has a unique name, so that a process which has
+	// lost its index lock cannot write into another's save.
+	tmpfile, err := os.CreateTemp(cachedir, cacheindexfilename+".*.tmp")
+	if err != nil {
+		return err
+	}
+	tmppath := tmpfile.Name()
+	_, err = tmpfile.Write(data)
+	if closeerr := tmpfile.Close(); err == nil {
+		err = closeerr
+	}
+	if err == nil {
+		err = os.Chmod(tmppath, 0644)
+	}
+	if err == nil {
+		err = os.Rename(tmppath, filepath.Join(cachedir, cacheindexfilename))
+	}
+	if err != nil {
+		os.Remove(tmppath)
+	}
+
+	return err
+}
+
+// readcacheindex calls f with the current cache index. Changes made by f
+// are not saved.
+func readcacheindex(f func(cachedir string, index *cacheindex) error) error {
+	cacheindexlock.Lock()
+	defer cacheindexlock.Unlock()
+
+	cachedir, err := CacheDir()
+	if err != nil {
+		return err
+	}
+
+	index, err := loadcacheindex(cachedir)
+	if err != nil {
+		return err
+	}
+
+	return f(cachedir, index)
+}
+
+// updatecacheindex calls f with the current cache index, and saves the
+// index if f succeeds. A lock file is held from loading to saving, so that
+// updates made by other processes are not lost.
+func updatecacheindex(f func(cachedir string, index *cacheindex) error) error {
+	cacheindexlock.Lock()
+	defer cacheindexlock.Unlock()
+
+	cachedir, err := CacheDir()
+	if err != nil {
+		return err
+	}
+
+	lock, _, err := acquirefilelock(
+		context.Background(),
+		filepath.Join(cachedir, cacheindexfilename+".lock"),
+	)
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	index, err := loadcacheindex(cachedir)
+	if err != nil {
+		return err
+	}
+
+	err = f(cachedir, index)
+	if err != nil {
+		return err
+	}
+
+	return savecacheindex(cachedir, index)
+}
+
+// cacherelativepath converts a path to a slash-separated path relative to
+// the cache directory. Relative paths are taken to be relative to the cache
+// directory already. Paths outside the cache directory are rejected.
+func cacherelativepath(cachedir string, path string) (string, error) {
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(cachedir, path)
+	}
+
+	relpath, err := filepath.Rel(cachedir, path)
+	if err != nil {
+		return "", err
+	}
+
+	if relpath == "." ||
+		relpath == ".." ||
+		strings.HasPrefix(relpath, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("%s is not a file under the cache directory", path)
+	}
+
+	return filepath.ToSlash(relpath), nil
+}
+
+// AddCacheEntry records a file under the cache directory in the cache index,
+// with the specified key and labels. The path can be absolute, or relative
+// to the cache directory. If the key already exists, its details are updated,
+// but its owners are retained.
+func AddCacheEntry(key string, path string, labels ...string) (*CacheEntry, error) {
+	if key == "" {
+		return nil, errors.New("cache entry key must not be empty")
+	}
+
+	var result *CacheEntry
+	err := updatecacheindex(func(cachedir string, index *cacheindex) error {
+		relpath, err := cacherelativepath(cachedir, path)
+		if err != nil {
+			return err
+		}
+
+		entry, err := recordcacheentry(cachedir, index, key, relpath, labels)
+		if err != nil {
+			return err
+		}
+
+		result = entry.clone()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+// recordcacheentry adds or updates an index entry for a file, which must
+// exist at relpath under the cache directory. Any details about where the
+// file came from are cleared, and should be set by the caller if known.
+func recordcacheentry(cachedir string, index *cacheindex, key string, relpath string, labels []string) (*CacheEntry, error) {
+	fullpath := filepath.Join(cachedir, filepath.FromSlash(relpath))
+	fileinfo, err := os.Stat(fullpath)
+	if err != nil {
+		return nil, err
+	}
+	if !fileinfo.Mode().IsRegular() {
+		return nil, fmt.Errorf("%s is not a regular file", fullpath)
+	}
+
+	checksum, err := ChecksumFile(fullpath)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UTC()
+	entry, ok := index.Entries[key]
+	if !ok {
+		entry = &CacheEntry{Key: key, Created: now}
+		index.Entries[key] = entry
+	}
+
+	entry.Path = relpath
+	entry.Size = fileinfo.Size()
+	entry.Checksum = checksum
+	entry.Labels = append([]string(nil), labels...)
+	entry.SourceURL = ""
+	entry.ETag = ""
+	entry.LastModified = ""
+	entry.Expires = time.Time{}
+	entry.LastUsed = now
+
+	kuttilog.Printf(
+		kuttilog.Verbose,
+		"Cache entry '%s' recorded for %s.",
+		key,
+		relpath,
+	)
+
+	return entry, nil
+}
+
+// GetCacheEntry returns the cache entry with the specified key, and marks it
+// as used. If the key does not exist, ErrCacheEntryNotFound is returned.
+// Lookups are counted as cache hits or misses.
+func GetCacheEntry(key string) (*CacheEntry, error) {
+	var result *CacheEntry
+	err := updatecacheindex(func(cachedir string, index *cacheindex) error {
+		entry, ok := index.Entries[key]
+		if !ok {
+			index.Misses++
+			return nil
+		}
+
+		index.Hits++
+		entry.LastUsed = time.Now().UTC()
+		result = entry.clone()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if result == nil {
+		return nil, ErrCacheEntryNotFound
+	}
+
+	return result, nil
+}
+
+// ListCacheEntries returns all entries in the cache index, sorted by key.
+func ListCacheEntries() ([]*CacheEntry, error) {
+	var result []*CacheEntry
+	err := readcacheindex(func(cachedir string, index *cacheindex) error {
+		result = make([]*CacheEntry, 0, len(index.Entries))
+		for _, entry := range index.Entries {
+			result = append(result, entry.clone())
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Key < result[j].Key
+	})
+	return result, nil
+}
+
+// RemoveCacheEntry deletes the file of the cache entry with the specified
+// key, and removes the entry from the cache index. Pinned entries cannot
+// be removed.
+func RemoveCacheEntry(key string) error {
+	return updatecacheindex(func(cachedir string, index *cacheindex) error {
+		entry, ok := index.Entries[key]
+		if !ok {
+			return ErrCacheEntryNotFound
+		}
+
+		if entry.Pinned() {
+			return fmt.Errorf(
+				"cache entry %s is pinned by %s",
+				key,
+				strings.Join(entry.Owners, ", "),
+			)
+		}
+
+		err := os.Remove(filepath.Join(cachedir, filepath.FromSlash(entry.Path)))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		delete(index.Entries, key)
+		return nil
+	})
+}
@@ -0,0 +1,144 @@
+package workspace
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// CacheUsageBucket reports usage for a group of cached files.
+type CacheUsageBucket struct {
+	// Files is the number of files in the group.
+	Files int `json:"files"`
+	// Entries is the number of cache index entries in the group.
+	Entries int `json:"entries"`
+	// Size is the total size of the files in bytes.
+	Size int64 `json:"size"`
+}
+
+// CacheEntryTime identifies a cache entry and a time associated with it.
+type CacheEntryTime struct {
+	Key  string    `json:"key"`
+	Time time.Time `json:"time"`
+}
+
+// CacheUsageReport reports how the cache directory is being used.
+type CacheUsageReport struct {
+	// Directory is the full path of the cache directory.
+	Directory string `json:"directory"`
+	// Total covers all files under the cache directory.
+	Total CacheUsageBucket `json:"total"`
+	// BySubdirectory groups files by the top-level subdirectory of the
+	// cache directory that they are in. Files directly in the cache
+	// directory are grouped under ".".
+	BySubdirectory map[string]CacheUsageBucket `json:"bysubdirectory"`
+	// ByLabel groups cache index entries by label. An entry with multiple
+	// labels is counted under each.
+	ByLabel map[string]CacheUsageBucket `json:"bylabel"`
+	// Oldest is the cache index entry created earliest, if any.
+	Oldest *CacheEntryTime `json:"oldest,omitempty"`
+	// Newest is the cache index entry created latest, if any.
+	Newest *CacheEntryTime `json:"newest,omitempty"`
+	// Hits is the number of cache lookups that found a usable entry.
+	Hits int64 `json:"hits"`
+	// Misses is the number of cache lookups that did not.
+	Misses int64 `json:"misses"`
+	// Reclaimable is the number of bytes in files of unpinned entries,
+	// which GC can free.
+	Reclaimable int64 `json:"reclaimable"`
+	// Orphaned is the number of bytes in files not recorded in the cache
+	// index, which GC can free if RemoveOrphans is set. Files of downloads
+	// and copies in progress are not counted.
+	Orphaned int64 `json:"orphaned"`
+}
+
+// CacheUsage returns a report of how the current cache directory is being
+// used. The report can be serialized as JSON.
+func CacheUsage() (*CacheUsageReport, error) {
+	result := &CacheUsageReport{
+		BySubdirectory: map[string]CacheUsageBucket{},
+		ByLabel:        map[string]CacheUsageBucket{},
+	}
+
+	err := readcacheindex(func(cachedir string, index *cacheindex) error {
+		result.Directory = cachedir
+		result.Hits = index.Hits
+		result.Misses = index.Misses
+
+		entriesbypath := map[string][]*CacheEntry{}
+		for _, entry := range index.Entries {
+			entriesbypath[entry.Path] = append(entriesbypath[entry.Path], entry)
+
+			if result.Oldest == nil || entry.Created.Before(result.Oldest.Time) {
+				result.Oldest = &CacheEntryTime{Key: entry.Key, Time: entry.Created}
+			}
+			if result.Newest == nil || entry.Created.After(result.Newest.Time) {
+				result.Newest = &CacheEntryTime{Key: entry.Key, Time: entry.Created}
+			}
+		}
+
+		return filepath.WalkDir(cachedir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil {
+				return err
+			}
+			if !d.Type().IsRegular() {
+				return nil
+			}
+
+			relpath, err := filepath.Rel(cachedir, path)
+			if err != nil {
+				return err
+			}
+			relpath = filepath.ToSlash(relpath)
+			if relpath == cacheindexfilename {
+				return nil
+			}
+
+			fileinfo, err := d.Info()
+			if err != nil {
+				return err
+			}
+			size := fileinfo.Size()
+			entries := entriesbypath[relpath]
+
+			result.Total = result.Total.add(size, len(entries))
+
+			subdir := "."
+			if i := strings.Index(relpath, "/"); i >= 0 {
+				subdir = relpath[:i]
+			}
+			result.BySubdirectory[subdir] = result.BySubdirectory[subdir].add(size, len(entries))
+
+			pinned := false
+			for _, entry := range entries {
+				pinned = pinned || entry.Pinned()
+				for _, label := range entry.Labels {
+					result.ByLabel[label] = result.ByLabel[label].add(size, 1)
+				}
+			}
+			switch {
+			case len(entries) == 0:
+				if !inprogressfile(d.Name()) {
+					result.Orphaned += size
+				}
+			case !pinned:
+				result.Reclaimable += size
+			}
+
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func (cub CacheUsageBucket) add(size int64, entries int) CacheUsageBucket {
+	cub.Files++
+	cub.Entries += entries
+	cub.Size += size
+	return cub
+}
@@ -0,0 +1,282 @@
+package workspace
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"sync"
+
+	"github.com/kuttiproject/kuttilog"
+)
+
+// CacheRepair specifies what VerifyCache should do with bad entries.
+type CacheRepair int
+
+const (
+	// RepairNone only reports bad entries.
+	RepairNone CacheRepair = iota
+	// RepairRemove removes bad entries and their files. Pinned entries
+	// are not removed.
+	RepairRemove
+	// RepairRefetch fetches bad entries again from their recorded source
+	// URL. Entries without a source URL are removed, unless pinned.
+	RepairRefetch
+)
+
+// VerifyCacheOptions control the behaviour of VerifyCache.
+type VerifyCacheOptions struct {
+	// Workers is the number of files checksummed in parallel. If zero,
+	// the number of CPUs is used.
+	Workers int
+	// Progress, if not nil, is called as files are read. It reports
+	// bytes read so far, and total bytes to be read.
+	Progress ProgressFunc
+	// Repair specifies what to do with bad entries.
+	Repair CacheRepair
+}
+
+// CacheIssue describes a cache entry that failed verification.
+type CacheIssue struct {
+	// Key is the key of the entry.
+	Key string `json:"key"`
+	// Path is the path of the entry's file, relative to the cache directory.
+	Path string `json:"path"`
+	// Missing is true if the entry's file does not exist.
+	Missing bool `json:"missing"`
+	// Expected is the checksum recorded in the cache index.
+	Expected string `json:"expected"`
+	// Actual is the checksum of the file, if it exists.
+	Actual string `json:"actual,omitempty"`
+	// Repair is the action taken, if any: "removed" or "refetched".
+	Repair string `json:"repair,omitempty"`
+	// Error describes why the file could not be read or repaired, if so.
+	Error string `json:"error,omitempty"`
+}
+
+// VerifyCacheResult reports the outcome of VerifyCache.
+type VerifyCacheResult struct {
+	// Checked is the number of entries checked.
+	Checked int `json:"checked"`
+	// Issues are the entries that failed verification, sorted by key.
+	Issues []CacheIssue `json:"issues"`
+}
+
+// VerifyCache recomputes the checksums of all files in the cache index,
+// and compares them with the recorded checksums. Mismatched and missing
+// files are reported, and optionally repaired.
+func VerifyCache(options VerifyCacheOptions) (*VerifyCacheResult, error) {
+	entries, err := ListCacheEntries()
+	if err != nil {
+		return nil, err
+	}
+
+	cachedir, err := CacheDir()
+	if err != nil {
+		return nil, err
+	}
+
+	workers := options.Workers
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	progress := &aggregateprogress{callback: options.Progress}
+	for _, entry := range entries {
+		progress.total += entry.Size
+	}
+
+	var (
+		wg       sync.WaitGroup
+		issuesmu sync.Mutex
+		issues   []CacheIssue
+		work     = make(chan *CacheEntry)
+	)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for entry := range work {
+				issue := verifycacheentry(cachedir, entry, progress)
+				if issue != nil {
+					issuesmu.Lock()
+					issues = append(issues, *issue)
+					issuesmu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for _, entry := range entries {
+		work <- entry
+	}
+	close(work)
+	wg.Wait()
+
+	sort.Slice(issues, func(i, j int) bool {
+		return issues[i].Key < issues[j].Key
+	})
+
+	if options.Repair != RepairNone {
+		for i := range issues {
+			repaircacheentry(&issues[i], options.Repair)
+		}
+	}
+
+	return &VerifyCacheResult{
+		Checked: len(entries),
+		Issues:  issues,
+	}, nil
+}
+
+func verifycacheentry(cachedir string, entry *CacheEntry, progress *aggregateprogress) *CacheIssue {
+	issue := &CacheIssue{
+		Key:      entry.Key,
+		Path:     entry.Path,
+		Expected: entry.Checksum,
+	}
+
+	fullpath := filepath.Join(cachedir, filepath.FromSlash(entry.Path))
+	checksum, err := checksumfile(fullpath, progress.add)
+	if os.IsNotExist(err) {
+		kuttilog.Printf(kuttilog.Verbose, "Cache entry '%s': file %s is missing.", entry.Key, entry.Path)
+		issue.Missing = true
+		return issue
+	}
+	if err != nil {
+		issue.Error = err.Error()
+		return issue
+	}
+
+	if checksum != entry.Checksum {
+		kuttilog.Printf(kuttilog.Verbose, "Cache entry '%s': checksum mismatch.", entry.Key)
+		issue.Actual = checksum
+		return issue
+	}
+
+	kuttilog.Printf(kuttilog.Debug, "Cache entry '%s' verified.", entry.Key)
+	return nil
+}
+
+// describes reports whether an entry is still the one that failed
+// verification, rather than one changed or added again since.
+func (ci *CacheIssue) describes(entry *CacheEntry) bool {
+	return entry.Path == ci.Path && entry.Checksum == ci.Expected
+}
+
+func repaircacheentry(issue *CacheIssue, repair CacheRepair) {
+	var err error
+	if repair == RepairRefetch {
+		var refetched bool
+		refetched, err = refetchcacheentry(issue)
+		if refetched || err != nil {
+			if err != nil {
+				issue.Error = err.Error()
+			}
+			return
+		}
+	}
+
+	err = updatecacheindex(func(cachedir string, index *cacheindex) error {
+		entry, ok := index.Entries[issue.Key]
+		if !ok {
+			return nil
+		}
+		if !issue.describes(entry) {
+			return fmt.Errorf("entry changed after being verified")
+		}
+		fullpath := filepath.Join(cachedir, filepath.FromSlash(entry.Path))
+
+		if entry.Pinned() {
+			return fmt.Errorf("entry is pinned, and cannot be removed")
+		}
+
+		kuttilog.Printf(kuttilog.Verbose, "Removing bad cache entry '%s'.", entry.Key)
+		err := os.Remove(fullpath)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		delete(index.Entries, entry.Key)
+		issue.Repair = "removed"
+		return nil
+	})
+	if err != nil {
+		issue.Error = err.Error()
+	}
+}
+
+// refetchcacheentry downloads a bad cache entry's file again from its
+// source, if it has one. The cache index is not locked while downloading.
+// It returns false if the entry has no source.
+func refetchcacheentry(issue *CacheIssue) (bool, error) {
+	var (
+		entry    *CacheEntry
+		fullpath string
+	)
+	err := readcacheindex(func(cachedir string, index *cacheindex) error {
+		if found, ok := index.Entries[issue.Key]; ok && found.SourceURL != "" && issue.describes(found) {
+			entry = found.clone()
+			fullpath = filepath.Join(cachedir, filepath.FromSlash(entry.Path))
+		}
+		return nil
+	})
+	if err != nil || entry == nil {
+		return false, err
+	}
+
+	kuttilog.Printf(kuttilog.Verbose, "Refetching cache entry '%s' from %s...", entry.Key, entry.SourceURL)
+	err = DownloadFileContext(
+		context.Background(),
+		entry.SourceURL,
+		fullpath,
+		&DownloadOptions{
+			Checksum: Digest{Algorithm: "sha256", Value: entry.Checksum},
+		},
+	)
+	if err != nil {
+		return true, err
+	}
+
+	// The entry may have been changed or removed while downloading.
+	err = readcacheindex(func(cachedir string, index *cacheindex) error {
+		current, ok := index.Entries[issue.Key]
+		if !ok || !issue.describes(current) {
+			return fmt.Errorf("entry changed while being refetched")
+		}
+
+		issue.Repair = "refetched"
+		return nil
+	})
+
+	return true, err
+}
+
+// checksumfile calculates an SHA256 checksum of a file, reporting the
+// number of bytes read by each read via the supplied callback.
+func checksumfile(filepath string, read func(n int64)) (string, error) {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	previous := int64(0)
+	reader := &progressreader{
+		Reader: f,
+		callback: func(current int64, total int64) {
+			read(current - previous)
+			previous = current
+		},
+	}
+	if _, err := io.Copy(h, reader); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("%x", h.Sum(nil)), nil
+}
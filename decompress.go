@@ -0,0 +1,233 @@
+package workspace
+
+import (
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/ulikunitz/xz"
+)
+
+// DecompressAuto can be specified as DownloadOptions.Decompress to detect
+// the compression format from the file name or Content-Type.
+const DecompressAuto = "auto"
+
+// ErrUnsupportedCompression is returned, wrapped, when a compression format
+// is requested for which no decompressor or compressor is registered.
+var ErrUnsupportedCompression = errors.New("unsupported compression format")
+
+// Decompressor returns a reader that decompresses data read from r.
+type Decompressor func(r io.Reader) (io.ReadCloser, error)
+
+type decompression struct {
+	decompressor Decompressor
+	extensions   []string
+}
+
+var (
+	decompressorlock sync.RWMutex
+	decompressors    = map[string]*decompression{
+		"gzip": {
+			decompressor: func(r io.Reader) (io.ReadCloser, error) {
+				return gzip.NewReader(r)
+			},
+			extensions: []string{".gz"},
+		},
+		"bzip2": {
+			decompressor: func(r io.Reader) (io.ReadCloser, error) {
+				return io.NopCloser(bzip2.NewReader(r)), nil
+			},
+			extensions: []string{".bz2"},
+		},
+		"xz": {
+			decompressor: func(r io.Reader) (io.ReadCloser, error) {
+				xr, err := xz.NewReader(r)
+				if err != nil {
+					return nil, err
+				}
+				return io.NopCloser(xr), nil
+			},
+			extensions: []string{".xz"},
+		},
+		"zstd": {
+			decompressor: func(r io.Reader) (io.ReadCloser, error) {
+				zr, err := zstd.NewReader(r)
+				if err != nil {
+					return nil, err
+				}
+				return zr.IOReadCloser(), nil
+			},
+			extensions: []string{".zst", ".zstd"},
+		},
+	}
+
+	// compressioncontenttypes maps well-known Content-Types to format
+	// names. A format is only detected if a decompressor is registered
+	// for it.
+	compressioncontenttypes = map[string]string{
+		"application/gzip":    "gzip",
+		"application/x-gzip":  "gzip",
+		"application/x-bzip2": "bzip2",
+		"application/x-xz":    "xz",
+		"application/zstd":    "zstd",
+	}
+)
+
+// Compressor returns a writer that compresses data written to it into w.
+// Closing the writer must flush all data, but not close w.
+type Compressor func(w io.Writer) (io.WriteCloser, error)
+
+var (
+	compressorlock sync.RWMutex
+	compressors    = map[string]Compressor{
+		"gzip": func(w io.Writer) (io.WriteCloser, error) {
+			return gzip.NewWriter(w), nil
+		},
+		"xz": func(w io.Writer) (io.WriteCloser, error) {
+			return xz.NewWriter(w)
+		},
+		"zstd": func(w io.Writer) (io.WriteCloser, error) {
+			// A single encoder goroutine keeps the output the same
+			// from run to run.
+			return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+		},
+	}
+)
+
+// RegisterCompressor registers a compressor for a compression format, for
+// use by CreateArchive. The gzip, xz and zstd formats are registered by
+// default. Output should be deterministic, if archives are to be
+// reproducible.
+func RegisterCompressor(format string, compressor Compressor) {
+	compressorlock.Lock()
+	defer compressorlock.Unlock()
+
+	compressors[format] = compressor
+}
+
+// findcompressor returns the registered compressor for a format, or nil if
+// the format is empty.
+func findcompressor(format string) (Compressor, error) {
+	if format == "" {
+		return nil, nil
+	}
+
+	compressorlock.RLock()
+	defer compressorlock.RUnlock()
+
+	c, ok := compressors[format]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnsupportedCompression, format)
+	}
+
+	return c, nil
+}
+
+// RegisterDecompressor registers a decompressor for a compression format,
+// along with the file name extensions, such as ".lz4", that identify it.
+// The gzip, bzip2, xz and zstd formats are registered by default.
+func RegisterDecompressor(format string, decompressor Decompressor, extensions ...string) {
+	decompressorlock.Lock()
+	defer decompressorlock.Unlock()
+
+	decompressors[format] = &decompression{
+		decompressor: decompressor,
+		extensions:   extensions,
+	}
+}
+
+// finddecompressor returns the decompressor for a Decompress option, or nil
+// if data should be saved as is. For DecompressAuto, the format is detected
+// from the file name's extension, and then from the Content-Type.
+func finddecompressor(mode string, name string, contenttype string) (Decompressor, error) {
+	if mode == "" {
+		return nil, nil
+	}
+
+	decompressorlock.RLock()
+	defer decompressorlock.RUnlock()
+
+	if mode != DecompressAuto {
+		d, ok := decompressors[mode]
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrUnsupportedCompression, mode)
+		}
+		return d.decompressor, nil
+	}
+
+	if format, _ := compressionforname(name); format != "" {
+		return decompressors[format].decompressor, nil
+	}
+
+	mediatype, _, err := mime.ParseMediaType(contenttype)
+	if err == nil {
+		if d, ok := decompressors[compressioncontenttypes[mediatype]]; ok {
+			return d.decompressor, nil
+		}
+	}
+
+	return nil, nil
+}
+
+// compressionforname returns the registered compression format identified
+// by a file name's extension, and the name without that extension. If no
+// format matches, it returns an empty format and the name as is. The caller
+// must hold decompressorlock.
+func compressionforname(name string) (string, string) {
+	lowername := strings.ToLower(name)
+	for format, d := range decompressors {
+		for _, extension := range d.extensions {
+			if strings.HasSuffix(lowername, strings.ToLower(extension)) {
+				return format, name[:len(name)-len(extension)]
+			}
+		}
+	}
+
+	return "", name
+}
+
+// writedecompressedstream decompresses data from a reader and writes it to
+// a writer, stopping if the context is cancelled, and applying rate limits
+// to the compressed data. The verifier, if any, checks compressed or
+// decompressed data as specified by the options.
+func writedecompressedstream(ctx context.Context, out io.Writer, source io.Reader, size int64, decompressor Decompressor, verifier *digestverifier, options *DownloadOptions) error {
+	compressed := streamreader(ctx, source, 0, size, options)
+	if verifier != nil && !options.ChecksumDecompressed {
+		compressed = io.TeeReader(compressed, verifier)
+	}
+
+	reader, err := decompressor(compressed)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+
+	var decompressed io.Reader = reader
+	if options.DecompressedProgress != nil {
+		decompressed = &progressreader{
+			decompressed,
+			0,
+			0,
+			options.DecompressedProgress,
+		}
+	}
+	if verifier != nil && options.ChecksumDecompressed {
+		out = io.MultiWriter(out, verifier)
+	}
+
+	if _, err = io.Copy(out, decompressed); err != nil {
+		return err
+	}
+
+	// Drain anything following the compressed data, so that a verifier
+	// of the compressed stream sees all of it.
+	_, err = io.Copy(io.Discard, compressed)
+	return err
+}
@@ -0,0 +1,151 @@
+package workspace
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"strings"
+)
+
+// Digest is the expected checksum of a file.
+type Digest struct {
+	// Algorithm is the checksum algorithm: "sha256" or "sha512".
+	Algorithm string
+	// Value is the checksum as a hexadecimal string.
+	Value string
+}
+
+// ParseDigest parses a digest of the form "algorithm:value", such as
+// "sha256:1f79...". If no algorithm is specified, it is inferred from the
+// length of the value.
+func ParseDigest(digest string) (Digest, error) {
+	algorithm, value, found := strings.Cut(digest, ":")
+	if !found {
+		value = algorithm
+		switch len(value) {
+		case sha256.Size * 2:
+			algorithm = "sha256"
+		case sha512.Size * 2:
+			algorithm = "sha512"
+		default:
+			return Digest{}, fmt.Errorf("cannot infer checksum algorithm for '%s'", digest)
+		}
+	}
+
+	result := Digest{
+		Algorithm: strings.ToLower(algorithm),
+		Value:     strings.ToLower(value),
+	}
+	if _, err := result.newhash(); err != nil {
+		return Digest{}, err
+	}
+
+	return result, nil
+}
+
+func (d Digest) String() string {
+	return d.Algorithm + ":" + d.Value
+}
+
+// IsZero returns true if the digest is empty.
+func (d Digest) IsZero() bool {
+	return d.Algorithm == "" && d.Value == ""
+}
+
+func (d Digest) newhash() (hash.Hash, error) {
+	var (
+		h    hash.Hash
+		size int
+	)
+	switch strings.ToLower(d.Algorithm) {
+	case "sha256":
+		h, size = sha256.New(), sha256.Size
+	case "sha512":
+		h, size = sha512.New(), sha512.Size
+	default:
+		return nil, fmt.Errorf("unsupported checksum algorithm '%s'", d.Algorithm)
+	}
+
+	if decoded, err := hex.DecodeString(d.Value); err != nil || len(decoded) != size {
+		return nil, fmt.Errorf("invalid %s checksum '%s'", d.Algorithm, d.Value)
+	}
+
+	return h, nil
+}
+
+// ChecksumMismatchError is returned when a file does not match its
+// expected digest.
+type ChecksumMismatchError struct {
+	// Path is the file that was checked.
+	Path string
+	// Algorithm is the checksum algorithm.
+	Algorithm string
+	// Expected is the expected checksum.
+	Expected string
+	// Actual is the checksum of the file.
+	Actual string
+}
+
+func (cme *ChecksumMismatchError) Error() string {
+	return fmt.Sprintf(
+		"%s checksum mismatch for %s: expected %s, got %s",
+		cme.Algorithm,
+		cme.Path,
+		cme.Expected,
+		cme.Actual,
+	)
+}
+
+// digestverifier computes a checksum as data is written to it, and
+// compares it with an expected digest.
+type digestverifier struct {
+	hash.Hash
+	digest Digest
+}
+
+// newdigestverifier returns a verifier for the digest, or nil if the
+// digest is empty.
+func newdigestverifier(digest Digest) (*digestverifier, error) {
+	if digest.IsZero() {
+		return nil, nil
+	}
+
+	h, err := digest.newhash()
+	if err != nil {
+		return nil, err
+	}
+
+	return &digestverifier{Hash: h, digest: digest}, nil
+}
+
+// addfile adds the contents of an existing file to the checksum.
+func (dv *digestverifier) addfile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(dv, f)
+	return err
+}
+
+// verify compares the computed checksum with the expected one. The path
+// is used in the error.
+func (dv *digestverifier) verify(path string) error {
+	actual := hex.EncodeToString(dv.Sum(nil))
+	if actual != strings.ToLower(dv.digest.Value) {
+		return &ChecksumMismatchError{
+			Path:      path,
+			Algorithm: dv.digest.Algorithm,
+			Expected:  dv.digest.Value,
+			Actual:    actual,
+		}
+	}
+
+	return nil
+}
@@ -24,8 +24,73 @@
 // Data files can be stored directly in a workspace's cache directory, or preferably
 // in subdirectories under the cache directory.
 //
+// Files in the cache directory can be recorded in a cache index, using
+// AddCacheEntry. Indexed entries can be pinned by named owners using Pin, which
+// protects them from removal. The GC function removes unpinned entries, and
+// optionally files not recorded in the index. Entries can be given a TTL, and
+// FetchCacheEntry fetches files over HTTP into the cache, revalidating stale
+// entries with conditional requests. VerifyCache checks indexed files against
+// their recorded checksums, and can remove or refetch bad entries. CacheUsage
+// reports how much space the cache uses, and for what.
+//
 // Utilities
 //
 // The workspace package provides utilities for copying files, calculating checksums
 // of files, downloading files via HTTP get and running OS processes.
+// Progress of copies and downloads is reported via a ProgressFunc, or as
+// ProgressEvents with transfer rates, ETAs and phases. ProgressEvents adapts an
+// event handler for use wherever a ProgressFunc is accepted.
+// Downloads are performed by a Downloader, which can be given its own HTTP client,
+// per-host headers and user agent. NewWorkspaceDownloader creates one from proxy,
+// CA and header settings saved in the config directory. The package-level download
+// functions use the Downloader set by SetDefaultDownloader.
+//
+// DownloadFileContext downloads files with a context, which can be used to cancel
+// a download or set a deadline. Downloads can be verified against an expected
+// Digest while streaming, or against a ChecksumManifest such as a SHA256SUMS file.
+// Downloads and manifests can also be required to have a valid minisign signature
+// made by one of the workspace's trusted keys, which are managed by AddTrustedKey,
+// ListTrustedKeys and RemoveTrustedKey, and stored in the config directory.
+//
+// Compressed files can be decompressed while downloading, using the Decompress
+// download option. The gzip, bzip2, xz and zstd formats are supported, and others
+// can be added using RegisterDecompressor.
+//
+// ExtractArchive safely unpacks tar and zip archives, refusing entries that
+// would be written outside the destination directory, and enforcing size and
+// entry limits. CreateArchive packs a directory into a tar or zip archive with
+// deterministic output, so that archives of the same contents have the same
+// checksum.
+//
+// Downloads and copies can be throttled per transfer using their options, per
+// Downloader using a shared RateLimiter, or globally using SetRateLimit. The
+// GlobalRateLimit saved in the workspace's downloader config is applied by
+// LoadWorkspaceRateLimit.
+//
+// Besides http and https URLs, downloads accept local paths, file:// URLs and
+// data URLs. Layers of artifacts in OCI registries can be downloaded using
+// oci://registry/repository:tag URLs, and are verified against their digests.
+// Other schemes can be supported by registering a Fetcher using
+// RegisterFetcher.
+//
+// DownloadBatch downloads the files listed in a BatchManifest, which can be
+// loaded from a JSON file, several at a time. A batch can save its state, so
+// that an interrupted batch can be resumed.
+//
+// Copies, like downloads, are written to a temporary file and renamed into place
+// when complete, so that a failure never leaves a partial file at the
+// destination.
+//
+// Copies and downloads check that the destination has enough free space, plus
+// a margin set by SetFreeSpaceMargin, before writing anything. If not, they
+// fail with an *InsufficientSpaceError. FreeSpace reports the free space on a
+// filesystem.
+//
+// Progress can be displayed using a ProgressRenderer. NewProgressRenderer
+// chooses a bar, or a bar per transfer, when writing to a terminal, and
+// periodic log lines otherwise. A JSONRenderer writes events for other
+// programs.
+//
+// Downloads can be served from local mirror directories, set using SetMirrors.
+// In offline mode, set using SetOffline, files are only served from mirrors.
 package workspace
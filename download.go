@@ -0,0 +1,563 @@
+package workspace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/kuttiproject/kuttilog"
+)
+
+// ErrDownloadCancelled is returned, wrapped together with the context's
+// error, when a download is aborted because its context was cancelled or
+// its deadline passed.
+var ErrDownloadCancelled = errors.New("download cancelled")
+
+// DownloadOptions control the behaviour of DownloadFileContext.
+type DownloadOptions struct {
+	// Progress, if not nil, is called as the file is downloaded. It reports
+	// current and total numbers as bytes. The total is 0 if not known.
+	Progress ProgressFunc
+	// OnProgress, if not nil, receives progress events, including rates,
+	// ETAs and changes of phase, no more often than ProgressInterval.
+	OnProgress ProgressHandler
+	// ProgressInterval is the minimum interval between events delivered to
+	// OnProgress. If 0, DefaultProgressInterval is used.
+	ProgressInterval time.Duration
+	// Resume keeps partially downloaded files if a download fails or is
+	// cancelled, and resumes such files using HTTP range requests where
+	// the server supports them. If the server does not support ranges,
+	// or the file has changed at the source, the download is restarted.
+	Resume bool
+	// Retry specifies how a failed download is retried. If nil, the
+	// policy set by SetRetryPolicy is used. Retries resume partially
+	// downloaded files where possible, whether or not Resume is set.
+	Retry *RetryPolicy
+	// Checksum, if not empty, is the expected digest of the file. The
+	// checksum is computed while downloading, and the file is only saved
+	// to its destination if it matches. Otherwise, the download fails with
+	// a *ChecksumMismatchError.
+	Checksum Digest
+	// Signature, if not empty, is the URL or local path of a minisign
+	// signature for the file. The downloaded file is only saved to its
+	// destination if the signature is valid, and made by one of the
+	// workspace's trusted keys.
+	Signature string
+	// Chunks, if more than 1, downloads large files as this many ranges in
+	// parallel, if the server supports range requests and identifies the
+	// file's version with an ETag or Last-Modified header. Each range is
+	// retried separately according to the retry policy. Otherwise, the file
+	// is downloaded as a single stream.
+	Chunks int
+	// MinChunkSize is the smallest range downloaded in parallel. Files are
+	// split into fewer chunks if needed to respect it. If 0, 4MiB is used.
+	MinChunkSize int64
+	// RateLimit, if more than 0, limits the download to this many bytes per
+	// second. If 0, the Downloader's TransferRateLimit applies. Limits set by
+	// SetRateLimit and the Downloader's Limiter apply in addition.
+	RateLimit int64
+	// Decompress, if not empty, decompresses the file while downloading,
+	// and saves the decompressed data. It can be the name of a registered
+	// compression format such as "gzip", or DecompressAuto to detect the
+	// format from the URL or Content-Type. Decompressed downloads are not
+	// resumed or split into chunks.
+	Decompress string
+	// DecompressedProgress, if not nil, is called as decompressed data is
+	// written. It reports the number of bytes written so far, and 0.
+	// Progress still reports compressed bytes received.
+	DecompressedProgress ProgressFunc
+	// ChecksumDecompressed verifies Checksum against the decompressed data,
+	// instead of the data as downloaded.
+	ChecksumDecompressed bool
+
+	// signature holds the fetched contents of Signature.
+	signature []byte
+	// limiters hold the rate limiters for this download, other than the
+	// global one.
+	limiters []*RateLimiter
+	// tracker delivers events to OnProgress.
+	tracker *progresstracker
+	// revalidation, if not nil, makes HTTP downloads conditional on the
+	// file having changed since its validators were recorded, and receives
+	// the validators of the response.
+	revalidation *revalidation
+}
+
+// DownloadFileContext downloads a file from a url, using the default
+// Downloader. The download is aborted if the context is cancelled or its
+// deadline passes, in which case the returned error wraps both
+// ErrDownloadCancelled and the context's error, and any partially downloaded
+// file is removed unless options.Resume is set. The options parameter can
+// be nil.
+//
+// To abort a download on Ctrl-C, use a context from signal.NotifyContext.
+//
+// Only one download to a path runs at a time. Concurrent downloads of the
+// same url to the same path within this process share a single transfer,
+// and the saved file is checked against each download's own checksum and
+// signature. A lock file next to the path coordinates with other processes.
+func DownloadFileContext(ctx context.Context, url string, filepath string, options *DownloadOptions) error {
+	return DefaultDownloader().DownloadFileContext(ctx, url, filepath, options)
+}
+
+// DownloadFileContext downloads a file from a url. It behaves like the
+// package-level DownloadFileContext, but uses this Downloader's settings.
+func (d *Downloader) DownloadFileContext(ctx context.Context, url string, filepath string, options *DownloadOptions) error {
+	if options == nil {
+		options = &DownloadOptions{}
+	}
+
+	if _, err := finddecompressor(options.Decompress, "", ""); err != nil {
+		return err
+	}
+
+	if options.Signature != "" {
+		signature, err := d.fetchsignature(ctx, options.Signature)
+		if err != nil {
+			return err
+		}
+
+		signedoptions := *options
+		signedoptions.signature = signature
+		options = &signedoptions
+	}
+
+	transferlimit := options.RateLimit
+	if transferlimit <= 0 {
+		transferlimit = d.TransferRateLimit
+	}
+	limitedoptions := *options
+	limitedoptions.limiters = []*RateLimiter{d.Limiter, NewRateLimiter(transferlimit)}
+	options = &limitedoptions
+
+	if options.OnProgress != nil {
+		options.tracker = newprogresstracker(options.OnProgress, options.ProgressInterval)
+		options.Progress = combineprogress(options.Progress, options.tracker.update)
+		options.tracker.setphase(PhaseConnecting)
+	}
+
+	err := d.coalesceddownload(ctx, url, filepath, options)
+	if errors.Is(err, ErrDownloadCancelled) {
+		return err
+	}
+	if err != nil && ctx.Err() != nil {
+		kuttilog.Printf(kuttilog.Debug, "Download of %s cancelled: %v", url, ctx.Err())
+		return fmt.Errorf("%w: %w", ErrDownloadCancelled, ctx.Err())
+	}
+	if err == nil {
+		options.tracker.setphase(PhaseDone)
+	}
+
+	return err
+}
+
+func (d *Downloader) downloadfile(ctx context.Context, url string, filepath string, options *DownloadOptions) error {
+	localpath, fetchurl, fetcher, err := parsesource(url)
+	if err != nil {
+		return err
+	}
+
+	if localpath != "" {
+		kuttilog.Printf(kuttilog.Debug, "Copying local file %s...", localpath)
+		return savefromfile(ctx, localpath, filepath, options)
+	}
+	if fetchurl != nil && fetchurl.Scheme == "oci" {
+		fetcher = d.fetchoci
+	}
+
+	if fetchurl != nil && fetchurl.Scheme == "data" {
+		return savefetched(ctx, fetcher, fetchurl, filepath, options)
+	}
+
+	if mirroredpath, ok := findinmirrors(url); ok {
+		kuttilog.Printf(kuttilog.Debug, "Using mirrored file %s for %s...", mirroredpath, url)
+		return savefromfile(ctx, mirroredpath, filepath, options)
+	}
+
+	if Offline() {
+		return &OfflineError{URL: url}
+	}
+
+	policy := options.Retry
+	if policy == nil {
+		policy = GlobalRetryPolicy()
+	}
+
+	if fetcher != nil {
+		return retrydownload(ctx, url, policy, func() error {
+			return savefetched(ctx, fetcher, fetchurl, filepath, options)
+		})
+	}
+
+	if options.Chunks > 1 && options.Decompress == "" {
+		err := d.chunkeddownloadfile(ctx, url, filepath, options, policy)
+		if !errors.Is(err, errrangesunsupported) {
+			return err
+		}
+		kuttilog.Printf(kuttilog.Debug, "%v. Downloading %s as a single stream.", err, url)
+	}
+
+	attemptoptions := *options
+	if policy.attempts() > 1 {
+		attemptoptions.Resume = true
+	}
+	if options.Decompress != "" {
+		attemptoptions.Resume = false
+	}
+
+	err = retrydownload(ctx, url, policy, func() error {
+		return d.httpdownloadfile(ctx, url, filepath, &attemptoptions)
+	})
+	if err != nil && !options.Resume {
+		tmpfilepath := filepath + ".download"
+		os.Remove(tmpfilepath)
+		os.Remove(tmpfilepath + ".json")
+	}
+
+	return err
+}
+
+// retrydownload calls attempt until it succeeds, the retry policy gives up,
+// or the context is done.
+func retrydownload(ctx context.Context, url string, policy *RetryPolicy, attempt func() error) error {
+	maxattempts := policy.attempts()
+	for i := 1; ; i++ {
+		err := attempt()
+		if err == nil ||
+			i >= maxattempts ||
+			ctx.Err() != nil ||
+			!policy.retryable(err) {
+			return err
+		}
+
+		delay := policy.backoff(i, err)
+		kuttilog.Printf(
+			kuttilog.Info,
+			"Download of %s failed (attempt %v of %v): %v. Retrying in %v...",
+			url,
+			i,
+			maxattempts,
+			err,
+			delay.Round(time.Millisecond),
+		)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return err
+		}
+
+		kuttilog.Printf(kuttilog.Debug, "Retrying download of %s...", url)
+	}
+}
+
+// httpdownloadfile downloads a file over the network, bypassing mirrors.
+func (d *Downloader) httpdownloadfile(ctx context.Context, url string, filepath string, options *DownloadOptions) error {
+	tmpfilepath := filepath + ".download"
+	statepath := tmpfilepath + ".json"
+
+	offset := int64(0)
+	var state *downloadstate
+	if options.Resume {
+		offset, state = resumableoffset(url, tmpfilepath, statepath)
+	}
+
+	kuttilog.Printf(kuttilog.Debug, "Connecting to %s...", url)
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+
+	if offset > 0 {
+		kuttilog.Printf(kuttilog.Debug, "Resuming download from byte %v...", offset)
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", state.validator())
+	} else {
+		options.revalidation.addconditions(req)
+	}
+
+	resp, err := d.do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	options.revalidation.record(resp)
+
+	switch {
+	case resp.StatusCode == http.StatusNotModified && options.revalidation.conditional():
+		return errnotmodified
+	case resp.StatusCode == http.StatusOK:
+		if offset > 0 {
+			kuttilog.Printf(kuttilog.Debug, "Server sent the whole file. Restarting download.")
+		}
+		offset = 0
+	case resp.StatusCode == http.StatusPartialContent && offset > 0:
+		start, err := contentrangestart(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		if start != offset {
+			return fmt.Errorf("server returned range starting at %v instead of %v", start, offset)
+		}
+	case resp.StatusCode == http.StatusRequestedRangeNotSatisfiable && offset > 0:
+		kuttilog.Printf(kuttilog.Debug, "Partial file cannot be resumed. Restarting download.")
+		resp.Body.Close()
+		os.Remove(tmpfilepath)
+		os.Remove(statepath)
+		return d.httpdownloadfile(ctx, url, filepath, options)
+	default:
+		return newhttpstatuserror(resp)
+	}
+
+	if !options.Resume {
+		return saveresponse(ctx, resp, filepath, options)
+	}
+
+	verifier, err := newdigestverifier(options.Checksum)
+	if err != nil {
+		return err
+	}
+	if verifier != nil && offset > 0 {
+		err = verifier.addfile(tmpfilepath)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Only the remainder of a resumed file is needed
+	if err := checkfreespace(filepath, resp.ContentLength); err != nil {
+		return err
+	}
+
+	flags := os.O_CREATE | os.O_WRONLY | os.O_TRUNC
+	if offset > 0 {
+		flags = os.O_WRONLY | os.O_APPEND
+	}
+	out, err := os.OpenFile(tmpfilepath, flags, 0644)
+	if err != nil {
+		return err
+	}
+
+	if offset == 0 {
+		err = savedownloadstate(statepath, &downloadstate{
+			URL:          url,
+			ETag:         resp.Header.Get("ETag"),
+			LastModified: resp.Header.Get("Last-Modified"),
+		})
+		if err != nil {
+			out.Close()
+			return err
+		}
+	}
+
+	total := resp.ContentLength
+	if total >= 0 {
+		total += offset
+	}
+	reservespace(out, total)
+
+	err = writestream(ctx, withverifier(out, verifier), resp.Body, offset, total, options)
+	if closeerr := out.Close(); err == nil {
+		err = closeerr
+	}
+	if err != nil {
+		kuttilog.Printf(kuttilog.Debug, "Download interrupted. Partial file %v kept.", tmpfilepath)
+		return err
+	}
+
+	os.Remove(statepath)
+	return finishdownload(tmpfilepath, filepath, verifier, options)
+}
+
+// saveresponse saves the body of an HTTP response into a temporary file,
+// and then renames it to the specified path.
+func saveresponse(ctx context.Context, resp *http.Response, filepath string, options *DownloadOptions) error {
+	name := ""
+	if resp.Request != nil {
+		name = resp.Request.URL.Path
+	}
+	decompressor, err := finddecompressor(options.Decompress, name, resp.Header.Get("Content-Type"))
+	if err != nil {
+		return err
+	}
+
+	return savestream(ctx, resp.Body, resp.ContentLength, filepath, decompressor, options)
+}
+
+// savefromfile copies a local file, such as one in a mirror, into a
+// temporary file, and then renames it to the specified path.
+func savefromfile(ctx context.Context, sourcepath string, filepath string, options *DownloadOptions) error {
+	source, err := os.Open(sourcepath)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	sourceinfo, err := source.Stat()
+	if err != nil {
+		return err
+	}
+	if !sourceinfo.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", sourcepath)
+	}
+
+	decompressor, err := finddecompressor(options.Decompress, sourcepath, "")
+	if err != nil {
+		return err
+	}
+
+	return savestream(ctx, source, sourceinfo.Size(), filepath, decompressor, options)
+}
+
+// savestream saves data from a reader into a temporary file, decompressing
+// it if a decompressor is specified, and then renames it to the specified
+// path. If anything fails, or the context is cancelled, the temporary file
+// is removed.
+func savestream(ctx context.Context, source io.Reader, size int64, filepath string, decompressor Decompressor, options *DownloadOptions) error {
+	verifier, err := newdigestverifier(options.Checksum)
+	if err != nil {
+		return err
+	}
+
+	// Decompressed data is larger, but its size is not known in advance
+	if err := checkfreespace(filepath, size); err != nil {
+		return err
+	}
+
+	tmpfilepath := filepath + ".download"
+	out, err := os.Create(tmpfilepath)
+	if err != nil {
+		return err
+	}
+
+	if decompressor != nil {
+		err = writedecompressedstream(ctx, out, source, size, decompressor, verifier, options)
+	} else {
+		reservespace(out, size)
+		err = writestream(ctx, withverifier(out, verifier), source, 0, size, options)
+	}
+	if err != nil {
+		out.Close()
+		os.Remove(tmpfilepath)
+		return err
+	}
+
+	err = out.Close()
+	if err != nil {
+		os.Remove(tmpfilepath)
+		return err
+	}
+
+	kuttilog.Printf(kuttilog.Debug, "Saved to temporary file %v.", tmpfilepath)
+
+	return finishdownload(tmpfilepath, filepath, verifier, options)
+}
+
+// withverifier returns a writer that writes to both out and the verifier,
+// or just out if there is no verifier.
+func withverifier(out io.Writer, verifier *digestverifier) io.Writer {
+	if verifier == nil {
+		return out
+	}
+
+	return io.MultiWriter(out, verifier)
+}
+
+// finishdownload checks a completely downloaded temporary file against the
+// verifier and signature, if any, and then renames it to the specified path.
+// If a check fails, the temporary file is removed.
+func finishdownload(tmpfilepath string, filepath string, verifier *digestverifier, options *DownloadOptions) error {
+	if verifier != nil || options.signature != nil {
+		options.tracker.setphase(PhaseVerifying)
+	}
+
+	if verifier != nil {
+		if err := verifier.verify(filepath); err != nil {
+			os.Remove(tmpfilepath)
+			return err
+		}
+		kuttilog.Printf(kuttilog.Debug, "Checksum of %v verified.", tmpfilepath)
+	}
+
+	if options.signature != nil {
+		if err := VerifySignature(tmpfilepath, options.signature); err != nil {
+			os.Remove(tmpfilepath)
+			return err
+		}
+		kuttilog.Printf(kuttilog.Debug, "Signature of %v verified.", tmpfilepath)
+	}
+
+	options.tracker.setphase(PhaseRenaming)
+	return replacefile(tmpfilepath, filepath)
+}
+
+// writestream copies data from a reader to a writer, stopping if the
+// context is cancelled, and applying rate limits. Progress is reported
+// starting from offset.
+func writestream(ctx context.Context, out io.Writer, source io.Reader, offset int64, total int64, options *DownloadOptions) error {
+	_, err := io.Copy(out, streamreader(ctx, source, offset, total, options))
+	return err
+}
+
+// streamreader returns a reader that stops reading if the context is
+// cancelled, applies rate limits and reports progress starting from offset.
+func streamreader(ctx context.Context, source io.Reader, offset int64, total int64, options *DownloadOptions) io.Reader {
+	if total < 0 {
+		total = 0
+	}
+
+	var sourcereader io.Reader = &contextreader{ctx: ctx, Reader: source}
+	sourcereader = withratelimits(ctx, sourcereader, ratelimiters(options.limiters...))
+	if options.Progress != nil {
+		sourcereader = &progressreader{
+			sourcereader,
+			offset,
+			total,
+			options.Progress,
+		}
+	}
+
+	return sourcereader
+}
+
+// replacefile renames a completely downloaded temporary file to the
+// specified path, replacing any existing file.
+func replacefile(tmpfilepath string, filepath string) error {
+	// Renaming replaces an existing file atomically, so that it is never
+	// missing. If that fails, as it can on Windows, remove the destination
+	// path and try again.
+	if err := os.Rename(tmpfilepath, filepath); err != nil {
+		if _, staterr := os.Stat(filepath); staterr != nil {
+			return err
+		}
+		os.RemoveAll(filepath)
+		if err := os.Rename(tmpfilepath, filepath); err != nil {
+			return err
+		}
+	}
+
+	kuttilog.Printf(kuttilog.Debug, "Downloaded to file %v.", filepath)
+
+	return nil
+}
+
+// contextreader stops reading once its context is done.
+type contextreader struct {
+	io.Reader
+	ctx context.Context
+}
+
+func (cr *contextreader) Read(dst []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+
+	return cr.Reader.Read(dst)
+}
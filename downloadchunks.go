@@ -0,0 +1,231 @@
+package workspace
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/kuttiproject/kuttilog"
+)
+
+const defaultminchunksize = 4 * 1024 * 1024
+
+var (
+	errrangesunsupported = errors.New("server does not support range requests")
+	errchangedatsource   = errors.New("file changed at source during download")
+)
+
+// chunkeddownloadfile downloads a file as several ranges in parallel, into
+// a preallocated temporary file. If the server does not support ranges, or
+// the file is too small to be split, errrangesunsupported is returned.
+func (d *Downloader) chunkeddownloadfile(ctx context.Context, url string, filepath string, options *DownloadOptions, policy *RetryPolicy) error {
+	var (
+		size      int64
+		validator string
+	)
+	err := retrydownload(ctx, url, policy, func() error {
+		var err error
+		size, validator, err = d.proberanges(ctx, url)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	minchunksize := options.MinChunkSize
+	if minchunksize <= 0 {
+		minchunksize = defaultminchunksize
+	}
+	chunks := int64(options.Chunks)
+	if size/chunks < minchunksize {
+		chunks = size / minchunksize
+	}
+	if chunks < 2 {
+		return fmt.Errorf("%w: file too small to split", errrangesunsupported)
+	}
+
+	verifier, err := newdigestverifier(options.Checksum)
+	if err != nil {
+		return err
+	}
+
+	if err := checkfreespace(filepath, size); err != nil {
+		return err
+	}
+
+	tmpfilepath := filepath + ".download"
+	out, err := os.Create(tmpfilepath)
+	if err != nil {
+		return err
+	}
+
+	reservespace(out, size)
+	err = out.Truncate(size)
+	if err == nil {
+		kuttilog.Printf(kuttilog.Debug, "Downloading %s in %v chunks...", url, chunks)
+		err = d.downloadchunks(ctx, url, validator, out, size, chunks, options, policy)
+	}
+	if closeerr := out.Close(); err == nil {
+		err = closeerr
+	}
+	if err == nil && verifier != nil {
+		err = verifier.addfile(tmpfilepath)
+	}
+	if err != nil {
+		os.Remove(tmpfilepath)
+		return err
+	}
+
+	return finishdownload(tmpfilepath, filepath, verifier, options)
+}
+
+// proberanges checks whether the server supports range requests for a
+// url, by requesting its first byte. It returns the size of the file, and
+// a validator for If-Range headers.
+func (d *Downloader) proberanges(ctx context.Context, url string) (int64, string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return 0, "", err
+	}
+	req.Header.Set("Range", "bytes=0-0")
+
+	resp, err := d.do(req)
+	if err != nil {
+		return 0, "", err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		return 0, "", errrangesunsupported
+	default:
+		return 0, "", newhttpstatuserror(resp)
+	}
+
+	var start, end, size int64
+	_, err = fmt.Sscanf(resp.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size)
+	if err != nil || start != 0 || size <= 0 {
+		return 0, "", fmt.Errorf("%w: size is unknown", errrangesunsupported)
+	}
+
+	state := &downloadstate{
+		ETag:         resp.Header.Get("ETag"),
+		LastModified: resp.Header.Get("Last-Modified"),
+	}
+
+	// Without a validator, a file that changes at the source while its
+	// chunks are downloaded would be silently spliced together.
+	validator := state.validator()
+	if validator == "" {
+		return 0, "", fmt.Errorf("%w: no validator for If-Range", errrangesunsupported)
+	}
+
+	return size, validator, nil
+}
+
+// downloadchunks downloads a file in the specified number of ranges in
+// parallel, writing each range at its offset in out.
+func (d *Downloader) downloadchunks(ctx context.Context, url string, validator string, out *os.File, size int64, chunks int64, options *DownloadOptions, policy *RetryPolicy) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	aggregate := &aggregateprogress{callback: options.Progress, total: size}
+	limiters := ratelimiters(options.limiters...)
+	chunksize := size / chunks
+
+	var (
+		wg       sync.WaitGroup
+		errlock  sync.Mutex
+		firsterr error
+	)
+	for i := int64(0); i < chunks; i++ {
+		start := i * chunksize
+		end := start + chunksize - 1
+		if i == chunks-1 {
+			end = size - 1
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			err := d.downloadchunk(ctx, url, validator, out, start, end, aggregate, limiters, policy)
+			if err != nil {
+				errlock.Lock()
+				if firsterr == nil {
+					firsterr = err
+					cancel()
+				}
+				errlock.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+
+	return firsterr
+}
+
+// downloadchunk downloads the range from start to end, inclusive. Retries
+// resume from the last byte written.
+func (d *Downloader) downloadchunk(ctx context.Context, url string, validator string, out *os.File, start int64, end int64, aggregate *aggregateprogress, limiters []*RateLimiter, policy *RetryPolicy) error {
+	writer := &chunkwriter{file: out, offset: start, progress: aggregate}
+
+	return retrydownload(ctx, url, policy, func() error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", writer.offset, end))
+		req.Header.Set("If-Range", validator)
+
+		resp, err := d.do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+
+		switch resp.StatusCode {
+		case http.StatusPartialContent:
+		case http.StatusOK:
+			return errchangedatsource
+		default:
+			return newhttpstatuserror(resp)
+		}
+
+		rangestart, err := contentrangestart(resp.Header.Get("Content-Range"))
+		if err != nil {
+			return err
+		}
+		if rangestart != writer.offset {
+			return fmt.Errorf("server returned range starting at %v instead of %v", rangestart, writer.offset)
+		}
+
+		// A longer body than requested must not overwrite the next chunk.
+		body := io.LimitReader(resp.Body, end-writer.offset+1)
+		source := withratelimits(ctx, &contextreader{ctx: ctx, Reader: body}, limiters)
+		_, err = io.Copy(writer, source)
+		if err == nil && writer.offset != end+1 {
+			err = io.ErrUnexpectedEOF
+		}
+		return err
+	})
+}
+
+// chunkwriter writes sequentially to a file from an offset, and reports
+// bytes written to an aggregate progress.
+type chunkwriter struct {
+	file     *os.File
+	offset   int64
+	progress *aggregateprogress
+}
+
+func (cw *chunkwriter) Write(p []byte) (int, error) {
+	n, err := cw.file.WriteAt(p, cw.offset)
+	cw.offset += int64(n)
+	cw.progress.add(int64(n))
+	return n, err
+}
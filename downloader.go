@@ -0,0 +1,323 @@
+package workspace
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const downloaderconfigfilename = "downloader.json"
+
+// Downloader downloads files over HTTP, using a configurable client and
+// per-host request headers. The zero value uses http.DefaultClient and no
+// extra headers. A Downloader should not be modified while downloads are in
+// progress.
+type Downloader struct {
+	// Client is the HTTP client used for requests. If nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+	// HostHeaders contain headers added to requests to particular hosts,
+	// such as authorization tokens for private mirrors. They are keyed by
+	// host name, optionally with a port, as in "mirror.example.com" or
+	// "localhost:8080". A host's headers are never sent to other hosts,
+	// even when a request is redirected, nor to OCI token servers.
+	HostHeaders map[string]http.Header
+	// UserAgent, if not empty, is sent as the User-Agent header.
+	UserAgent string
+	// Limiter, if not nil, limits the combined rate of all downloads made
+	// by this Downloader.
+	Limiter *RateLimiter
+	// TransferRateLimit, if more than 0, limits each download made by this
+	// Downloader to this many bytes per second, unless the download's
+	// options specify a limit.
+	TransferRateLimit int64
+	// RegistryCredentials hold credentials for OCI registries, keyed by
+	// registry host. Registries not listed are accessed anonymously.
+	RegistryCredentials map[string]RegistryCredential
+}
+
+var (
+	defaultdownloaderlock sync.RWMutex
+	defaultdownloader     = &Downloader{}
+)
+
+// DefaultDownloader returns the Downloader used by the package-level
+// download functions.
+func DefaultDownloader() *Downloader {
+	defaultdownloaderlock.RLock()
+	defer defaultdownloaderlock.RUnlock()
+
+	return defaultdownloader
+}
+
+// SetDefaultDownloader sets the Downloader used by the package-level
+// download functions. A nil Downloader restores the initial default,
+// which uses http.DefaultClient.
+func SetDefaultDownloader(d *Downloader) {
+	if d == nil {
+		d = &Downloader{}
+	}
+
+	defaultdownloaderlock.Lock()
+	defer defaultdownloaderlock.Unlock()
+
+	defaultdownloader = d
+}
+
+// DownloadFile downloads a file from a url.
+func (d *Downloader) DownloadFile(url string, filepath string) error {
+	return d.DownloadFileContext(context.Background(), url, filepath, nil)
+}
+
+// DownloadFileWithProgress downloads a file from a url and reports progress
+// via the supplied callback. The progress callback reports current and total
+// numbers as bytes.
+func (d *Downloader) DownloadFileWithProgress(url string, filepath string, progress ProgressFunc) error {
+	return d.DownloadFileContext(
+		context.Background(),
+		url,
+		filepath,
+		&DownloadOptions{Progress: progress},
+	)
+}
+
+// do sends an HTTP request with the Downloader's client, and the headers
+// for the request's host.
+func (d *Downloader) do(req *http.Request) (*http.Response, error) {
+	if len(d.HostHeaders) == 0 {
+		return d.send(req, d.client())
+	}
+
+	addheaders(req, d.hostheaders(req.URL))
+
+	// Headers of the original request are copied to redirects, so they
+	// have to be swapped for those of the new host.
+	client := *d.client()
+	checkredirect := client.CheckRedirect
+	client.CheckRedirect = func(req *http.Request, via []*http.Request) error {
+		for name := range d.hostheaders(via[len(via)-1].URL) {
+			req.Header.Del(name)
+		}
+		addheaders(req, d.hostheaders(req.URL))
+
+		if checkredirect != nil {
+			return checkredirect(req, via)
+		}
+		if len(via) >= 10 {
+			return errors.New("stopped after 10 redirects")
+		}
+		return nil
+	}
+
+	return d.send(req, &client)
+}
+
+// send sends an HTTP request with the specified client, without adding
+// host headers. It is used for requests to servers the host headers are
+// not meant for, such as OCI token servers.
+func (d *Downloader) send(req *http.Request, client *http.Client) (*http.Response, error) {
+	if d.UserAgent != "" {
+		req.Header.Set("User-Agent", d.UserAgent)
+	}
+
+	return client.Do(req)
+}
+
+func (d *Downloader) client() *http.Client {
+	if d.Client == nil {
+		return http.DefaultClient
+	}
+
+	return d.Client
+}
+
+// hostheaders returns the headers for the host of a URL. Headers keyed by
+// host and port take precedence over those keyed by host name alone.
+func (d *Downloader) hostheaders(u *url.URL) http.Header {
+	var byname http.Header
+	for host, header := range d.HostHeaders {
+		if strings.EqualFold(host, u.Host) {
+			return header
+		}
+		if strings.EqualFold(host, u.Hostname()) {
+			byname = header
+		}
+	}
+
+	return byname
+}
+
+func addheaders(req *http.Request, header http.Header) {
+	for name, values := range header {
+		for _, value := range values {
+			req.Header.Add(name, value)
+		}
+	}
+}
+
+// DownloaderConfig holds network settings for downloads. It implements
+// ConfigData, and is saved in the workspace config directory.
+type DownloaderConfig struct {
+	// ProxyURL is the URL of an HTTP proxy, which may include credentials
+	// for an authenticated proxy. If empty, the proxy is taken from the
+	// environment.
+	ProxyURL string `json:"proxyurl,omitempty"`
+	// CAFile is the path of a PEM file containing additional certificate
+	// authorities to trust, such as a corporate CA.
+	CAFile string `json:"cafile,omitempty"`
+	// ClientCertFile and ClientKeyFile are the paths of a PEM client
+	// certificate and key, for servers that require them.
+	ClientCertFile string `json:"clientcertfile,omitempty"`
+	ClientKeyFile  string `json:"clientkeyfile,omitempty"`
+	// TimeoutSeconds limits the time taken to connect to a server and
+	// receive response headers. It does not limit the time taken to
+	// download a file. If 0, there is no limit.
+	TimeoutSeconds int `json:"timeoutseconds,omitempty"`
+	// UserAgent, if not empty, is sent as the User-Agent header.
+	UserAgent string `json:"useragent,omitempty"`
+	// HostHeaders are added to requests to particular hosts. They are keyed
+	// by host name, optionally with a port, and then by header name.
+	HostHeaders map[string]map[string]string `json:"hostheaders,omitempty"`
+	// RateLimit, if more than 0, limits the combined rate of all downloads
+	// made by the Downloader to this many bytes per second. It becomes the
+	// Downloader's Limiter, and does not affect copies or other Downloaders.
+	RateLimit int64 `json:"ratelimit,omitempty"`
+	// TransferRateLimit, if more than 0, limits each download to this many
+	// bytes per second.
+	TransferRateLimit int64 `json:"transferratelimit,omitempty"`
+	// GlobalRateLimit, if more than 0, limits the combined rate of all
+	// downloads and copies in the process, by any Downloader, to this many
+	// bytes per second. Since it is process-wide, creating a Downloader does
+	// not apply it; LoadWorkspaceRateLimit does.
+	GlobalRateLimit int64 `json:"globalratelimit,omitempty"`
+}
+
+// Serialize converts the config to JSON.
+func (dc *DownloaderConfig) Serialize() ([]byte, error) {
+	return json.MarshalIndent(dc, "", "  ")
+}
+
+// Deserialize reads the config from JSON.
+func (dc *DownloaderConfig) Deserialize(data []byte) error {
+	var loaded DownloaderConfig
+	err := json.Unmarshal(data, &loaded)
+	if err == nil {
+		*dc = loaded
+	}
+	return err
+}
+
+// SetDefaults clears all settings.
+func (dc *DownloaderConfig) SetDefaults() {
+	*dc = DownloaderConfig{}
+}
+
+// LoadDownloaderConfig loads the downloader config saved in the current
+// workspace's config directory, and returns it along with a ConfigManager
+// that can be used to save changes.
+func LoadDownloaderConfig() (*DownloaderConfig, ConfigManager, error) {
+	config := &DownloaderConfig{}
+	cm, err := NewFileConfigManager(downloaderconfigfilename, config)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return config, cm, nil
+}
+
+// NewDownloader returns a Downloader with the specified settings. If config
+// is nil, defaults are used.
+func NewDownloader(config *DownloaderConfig) (*Downloader, error) {
+	if config == nil {
+		config = &DownloaderConfig{}
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+
+	if config.ProxyURL != "" {
+		proxyurl, err := url.Parse(config.ProxyURL)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy URL: %v", err)
+		}
+		transport.Proxy = http.ProxyURL(proxyurl)
+	}
+
+	if config.CAFile != "" || config.ClientCertFile != "" {
+		tlsconfig := &tls.Config{}
+
+		if config.CAFile != "" {
+			pem, err := os.ReadFile(config.CAFile)
+			if err != nil {
+				return nil, err
+			}
+
+			pool, err := x509.SystemCertPool()
+			if err != nil {
+				pool = x509.NewCertPool()
+			}
+			if !pool.AppendCertsFromPEM(pem) {
+				return nil, fmt.Errorf("no certificates found in %s", config.CAFile)
+			}
+			tlsconfig.RootCAs = pool
+		}
+
+		if config.ClientCertFile != "" {
+			cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+			if err != nil {
+				return nil, err
+			}
+			tlsconfig.Certificates = []tls.Certificate{cert}
+		}
+
+		transport.TLSClientConfig = tlsconfig
+	}
+
+	if config.TimeoutSeconds > 0 {
+		timeout := time.Duration(config.TimeoutSeconds) * time.Second
+		transport.DialContext = (&net.Dialer{
+			Timeout:   timeout,
+			KeepAlive: 30 * time.Second,
+		}).DialContext
+		transport.TLSHandshakeTimeout = timeout
+		transport.ResponseHeaderTimeout = timeout
+	}
+
+	hostheaders := map[string]http.Header{}
+	for host, headers := range config.HostHeaders {
+		header := http.Header{}
+		for name, value := range headers {
+			header.Set(name, value)
+		}
+		hostheaders[host] = header
+	}
+
+	return &Downloader{
+		Client:            &http.Client{Transport: transport},
+		HostHeaders:       hostheaders,
+		UserAgent:         config.UserAgent,
+		Limiter:           NewRateLimiter(config.RateLimit),
+		TransferRateLimit: config.TransferRateLimit,
+	}, nil
+}
+
+// NewWorkspaceDownloader returns a Downloader configured by the downloader
+// config saved in the current workspace's config directory. The global rate
+// limit in the config is not applied; use LoadWorkspaceRateLimit for that.
+func NewWorkspaceDownloader() (*Downloader, error) {
+	config, _, err := LoadDownloaderConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	return NewDownloader(config)
+}
@@ -0,0 +1,346 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/kuttiproject/kuttilog"
+)
+
+const (
+	filelockpollinterval    = 100 * time.Millisecond
+	filelockrefreshinterval = 15 * time.Second
+	filelockstaleafter      = time.Minute
+)
+
+// downloadflight is a download in progress within this process, which
+// other callers downloading the same url to the same path can wait for.
+type downloadflight struct {
+	url     string
+	options *DownloadOptions
+	done    chan struct{}
+	err     error
+
+	progresslock   sync.Mutex
+	progress       map[int]ProgressFunc
+	nextprogressid int
+}
+
+// addprogress adds a callback to receive the flight's progress, and returns
+// an id with which it can be removed.
+func (df *downloadflight) addprogress(progress ProgressFunc) int {
+	if progress == nil {
+		return -1
+	}
+
+	df.progresslock.Lock()
+	defer df.progresslock.Unlock()
+
+	if df.progress == nil {
+		df.progress = map[int]ProgressFunc{}
+	}
+	id := df.nextprogressid
+	df.nextprogressid++
+	df.progress[id] = progress
+	return id
+}
+
+// removeprogress stops a callback added by addprogress from receiving
+// progress.
+func (df *downloadflight) removeprogress(id int) {
+	df.progresslock.Lock()
+	defer df.progresslock.Unlock()
+
+	delete(df.progress, id)
+}
+
+func (df *downloadflight) broadcast(current int64, total int64) {
+	df.progresslock.Lock()
+	defer df.progresslock.Unlock()
+
+	for _, progress := range df.progress {
+		progress(current, total)
+	}
+}
+
+// canjoin reports whether a download of a url with the specified options can
+// share the result of the flight. The saved file must be what the caller
+// asked for, and it must be possible to check it against the caller's own
+// checksum and signature.
+func (df *downloadflight) canjoin(url string, options *DownloadOptions) bool {
+	lead := df.options
+	if lead.revalidation != nil || options.revalidation != nil {
+		return false
+	}
+	if df.url != url ||
+		lead.Decompress != options.Decompress ||
+		lead.ChecksumDecompressed != options.ChecksumDecompressed {
+		return false
+	}
+
+	// A checksum of compressed data cannot be checked against the saved,
+	// decompressed file.
+	return options.Decompress == "" || options.ChecksumDecompressed || lead.Checksum == options.Checksum
+}
+
+var (
+	flightslock sync.Mutex
+	flights     = map[string]*downloadflight{}
+)
+
+// coalesceddownload ensures that only one download to a path runs at a
+// time. Within this process, callers downloading the same url to the same
+// path, with the same decompression options, wait for the first caller's
+// download, receive its progress, and share its result. The saved file is
+// then checked against each such caller's own checksum and signature. Other
+// callers downloading to the same path wait their turn. Across processes,
+// a lock file next to the path is used.
+func (d *Downloader) coalesceddownload(ctx context.Context, url string, destpath string, options *DownloadOptions) error {
+	key, err := filepath.Abs(destpath)
+	if err != nil {
+		return err
+	}
+
+	for {
+		flightslock.Lock()
+		flight, ok := flights[key]
+		if !ok {
+			flight = &downloadflight{url: url, options: options, done: make(chan struct{})}
+			flight.addprogress(options.Progress)
+			flights[key] = flight
+			flightslock.Unlock()
+
+			return d.leaddownload(ctx, key, flight, destpath, options)
+		}
+
+		joined := flight.canjoin(url, options)
+		progressid := -1
+		if joined {
+			kuttilog.Printf(kuttilog.Debug, "Joining download of %s already in progress...", url)
+			progressid = flight.addprogress(options.Progress)
+		}
+		flightslock.Unlock()
+
+		select {
+		case <-flight.done:
+		case <-ctx.Done():
+			flight.removeprogress(progressid)
+			return ctx.Err()
+		}
+
+		// If the download was cancelled by its own caller, this caller
+		// should try again.
+		if !joined || errors.Is(flight.err, ErrDownloadCancelled) {
+			continue
+		}
+		if flight.err != nil {
+			return flight.err
+		}
+
+		return verifyjoined(destpath, flight.options, options)
+	}
+}
+
+// verifyjoined checks a file saved by a flight against the checksum and
+// signature of a caller that joined it, where they differ from those of
+// the caller that led it.
+func verifyjoined(destpath string, lead *DownloadOptions, options *DownloadOptions) error {
+	checksum := Digest{}
+	if options.Checksum != lead.Checksum {
+		checksum = options.Checksum
+	}
+
+	var signature []byte
+	if !bytes.Equal(options.signature, lead.signature) {
+		signature = options.signature
+	}
+
+	return verifysaved(destpath, checksum, signature)
+}
+
+func (d *Downloader) leaddownload(ctx context.Context, key string, flight *downloadflight, destpath string, options *DownloadOptions) error {
+	leadoptions := *options
+	leadoptions.Progress = flight.broadcast
+
+	err := d.lockeddownload(ctx, flight.url, destpath, &leadoptions)
+	if err != nil && ctx.Err() != nil {
+		err = fmt.Errorf("%w: %w", ErrDownloadCancelled, ctx.Err())
+	}
+
+	flightslock.Lock()
+	delete(flights, key)
+	flightslock.Unlock()
+
+	flight.err = err
+	close(flight.done)
+	return err
+}
+
+// lockeddownload downloads a file while holding a lock file next to the
+// destination. If it had to wait for the lock, and another process has
+// saved the destination meanwhile, the download is skipped. Revalidating
+// downloads are never skipped, since the validators of the file saved by
+// the other process are not known.
+func (d *Downloader) lockeddownload(ctx context.Context, url string, destpath string, options *DownloadOptions) error {
+	waitstart := time.Now()
+	lock, waited, err := acquirefilelock(ctx, destpath+".lock")
+	if err != nil {
+		return err
+	}
+	defer lock.release()
+
+	if waited && options.revalidation == nil && downloadedsince(destpath, waitstart, options) {
+		kuttilog.Printf(kuttilog.Verbose, "%s was downloaded by another process.", destpath)
+		return nil
+	}
+
+	return d.downloadfile(ctx, url, destpath, options)
+}
+
+// downloadedsince returns true if a file has been saved since the specified
+// time, and passes the checks specified in the options.
+func downloadedsince(destpath string, since time.Time, options *DownloadOptions) bool {
+	fileinfo, err := os.Stat(destpath)
+	if err != nil || fileinfo.ModTime().Before(since) {
+		return false
+	}
+
+	return verifysaved(destpath, options.Checksum, options.signature) == nil
+}
+
+// verifysaved checks a saved file against a checksum and signature, either
+// of which can be empty.
+func verifysaved(destpath string, checksum Digest, signature []byte) error {
+	verifier, err := newdigestverifier(checksum)
+	if err != nil {
+		return err
+	}
+	if verifier != nil {
+		if err := verifier.addfile(destpath); err != nil {
+			return err
+		}
+		if err := verifier.verify(destpath); err != nil {
+			return err
+		}
+	}
+
+	if signature != nil {
+		return VerifySignature(destpath, signature)
+	}
+
+	return nil
+}
+
+// filelock is a lock held by creating a file exclusively. While held, the
+// file's modification time is refreshed periodically, so that locks left
+// behind by crashed processes can be recognised as stale.
+type filelock struct {
+	path string
+	stop chan struct{}
+	done chan struct{}
+}
+
+// acquirefilelock waits until it can create the lock file, or the context
+// is done. It also returns true if it had to wait.
+func acquirefilelock(ctx context.Context, lockpath string) (*filelock, bool, error) {
+	waited := false
+	for {
+		f, err := os.OpenFile(lockpath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			fmt.Fprintf(f, "%d\n", os.Getpid())
+			f.Close()
+
+			lock := &filelock{
+				path: lockpath,
+				stop: make(chan struct{}),
+				done: make(chan struct{}),
+			}
+			go lock.refresh()
+			return lock, waited, nil
+		}
+		if !os.IsExist(err) {
+			return nil, waited, err
+		}
+
+		if lockinfo, err := os.Stat(lockpath); err == nil && stalelock(lockinfo) {
+			removestalelock(lockpath)
+			continue
+		}
+
+		if !waited {
+			kuttilog.Printf(kuttilog.Info, "Waiting for another process to release %s...", lockpath)
+			waited = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, waited, ctx.Err()
+		case <-time.After(filelockpollinterval):
+		}
+	}
+}
+
+// stalelock reports whether a lock file has not been refreshed for long
+// enough that its holder must have died.
+func stalelock(lockinfo os.FileInfo) bool {
+	return time.Since(lockinfo.ModTime()) > filelockstaleafter
+}
+
+// removestalelock removes a lock file found to be stale. Another waiter may
+// have found the same lock stale, removed it, and taken a new lock in its
+// place, which must not be removed. So the lock file is first moved aside
+// atomically, and removed only if it is still stale. A fresh lock moved
+// aside is put back, unless yet another lock has been taken meanwhile.
+func removestalelock(lockpath string) {
+	asidepath := fmt.Sprintf("%s.%08x.lock", lockpath, rand.Uint32())
+	if err := os.Rename(lockpath, asidepath); err != nil {
+		return
+	}
+
+	if asideinfo, err := os.Stat(asidepath); err == nil && stalelock(asideinfo) {
+		kuttilog.Printf(kuttilog.Verbose, "Removed stale lock file %s.", lockpath)
+		os.Remove(asidepath)
+		return
+	}
+
+	err := os.Link(asidepath, lockpath)
+	if err != nil && !os.IsExist(err) {
+		// Where hard links are not supported, rename the lock back if
+		// nothing has taken its place.
+		if _, err := os.Lstat(lockpath); os.IsNotExist(err) {
+			os.Rename(asidepath, lockpath)
+			return
+		}
+	}
+	os.Remove(asidepath)
+}
+
+func (fl *filelock) refresh() {
+	defer close(fl.done)
+
+	ticker := time.NewTicker(filelockrefreshinterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-fl.stop:
+			return
+		case <-ticker.C:
+			now := time.Now()
+			os.Chtimes(fl.path, now, now)
+		}
+	}
+}
+
+func (fl *filelock) release() {
+	close(fl.stop)
+	<-fl.done
+	os.Remove(fl.path)
+}
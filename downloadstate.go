@@ -0,0 +1,79 @@
+package workspace
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// downloadstate records where a partially downloaded temporary file came
+// from, so that the download can be resumed.
+type downloadstate struct {
+	URL          string `json:"url"`
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"lastmodified,omitempty"`
+}
+
+// validator returns a value suitable for an If-Range header, or an empty
+// string if there is none. Weak ETags cannot be used with If-Range.
+func (ds *downloadstate) validator() string {
+	if ds.ETag != "" && !strings.HasPrefix(ds.ETag, "W/") {
+		return ds.ETag
+	}
+
+	return ds.LastModified
+}
+
+func loaddownloadstate(statepath string) (*downloadstate, error) {
+	data, err := os.ReadFile(statepath)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &downloadstate{}
+	err = json.Unmarshal(data, result)
+	if err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func savedownloadstate(statepath string, state *downloadstate) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(statepath, data, 0644)
+}
+
+// resumableoffset returns the size of a partially downloaded temporary
+// file, and the state recorded for it, if the download can be resumed.
+// Otherwise, it returns 0.
+func resumableoffset(url string, tmpfilepath string, statepath string) (int64, *downloadstate) {
+	fileinfo, err := os.Stat(tmpfilepath)
+	if err != nil || fileinfo.Size() == 0 {
+		return 0, nil
+	}
+
+	state, err := loaddownloadstate(statepath)
+	if err != nil || state.URL != url || state.validator() == "" {
+		return 0, nil
+	}
+
+	return fileinfo.Size(), state
+}
+
+// contentrangestart parses the starting byte from a Content-Range header
+// value of the form "bytes start-end/total".
+func contentrangestart(contentrange string) (int64, error) {
+	var start, end int64
+	_, err := fmt.Sscanf(contentrange, "bytes %d-%d/", &start, &end)
+	if err != nil {
+		return 0, fmt.Errorf("invalid Content-Range '%s'", contentrange)
+	}
+
+	return start, nil
+}
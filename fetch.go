@@ -0,0 +1,144 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Fetcher opens the resource identified by a URL with a custom scheme. It
+// returns a reader for the resource's contents, and its size in bytes, or
+// -1 if the size is not known.
+type Fetcher func(ctx context.Context, u *url.URL) (io.ReadCloser, int64, error)
+
+var (
+	fetcherlock sync.RWMutex
+	fetchers    = map[string]Fetcher{
+		"data": fetchdata,
+	}
+)
+
+// RegisterFetcher registers a fetcher for URLs with the specified scheme,
+// such as "s3". Downloads of such URLs use the fetcher, and are saved,
+// verified and retried like downloads over HTTP. The http, https, file and
+// oci schemes are always handled by the package, and cannot be registered.
+func RegisterFetcher(scheme string, fetcher Fetcher) error {
+	scheme = strings.ToLower(scheme)
+	switch scheme {
+	case "http", "https", "file", "oci":
+		return fmt.Errorf("the %s scheme cannot be registered", scheme)
+	}
+
+	fetcherlock.Lock()
+	defer fetcherlock.Unlock()
+
+	fetchers[scheme] = fetcher
+	return nil
+}
+
+// parsesource works out how to fetch a download source. It returns a local
+// path for file:// URLs and plain paths, or a parsed URL and its fetcher for
+// registered schemes, or neither for http and https URLs. For oci:// URLs,
+// it returns the parsed URL, and the Downloader provides the fetcher.
+func parsesource(source string) (string, *url.URL, Fetcher, error) {
+	scheme, _, found := strings.Cut(source, ":")
+	// A single letter is a Windows drive, as in C:\images\node.img
+	if !found || len(scheme) < 2 || strings.ContainsAny(scheme, `/\`) {
+		return source, nil, nil, nil
+	}
+
+	scheme = strings.ToLower(scheme)
+	if scheme == "http" || scheme == "https" {
+		return "", nil, nil, nil
+	}
+
+	u, err := url.Parse(source)
+	if err != nil {
+		return "", nil, nil, err
+	}
+
+	switch scheme {
+	case "file":
+		localpath, err := fileurlpath(u)
+		return localpath, nil, nil, err
+	case "oci":
+		return "", u, nil, nil
+	}
+
+	fetcherlock.RLock()
+	fetcher, ok := fetchers[scheme]
+	fetcherlock.RUnlock()
+	if !ok {
+		return "", nil, nil, fmt.Errorf("unsupported URL scheme %s", scheme)
+	}
+
+	return "", u, fetcher, nil
+}
+
+// fileurlpath returns the local path referred to by a file:// URL.
+func fileurlpath(u *url.URL) (string, error) {
+	if u.Host != "" && u.Host != "localhost" {
+		return "", errors.New("file:// URLs must refer to the local host")
+	}
+
+	// file:///C:/mirror has the path /C:/mirror
+	localpath := u.Path
+	if len(localpath) > 2 && localpath[0] == '/' && localpath[2] == ':' {
+		localpath = localpath[1:]
+	}
+
+	return filepath.FromSlash(localpath), nil
+}
+
+// savefetched saves the contents of a resource opened by a fetcher into a
+// temporary file, and then renames it to the specified path.
+func savefetched(ctx context.Context, fetcher Fetcher, u *url.URL, filepath string, options *DownloadOptions) error {
+	source, size, err := fetcher(ctx, u)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+
+	decompressor, err := finddecompressor(options.Decompress, u.Path, "")
+	if err != nil {
+		return err
+	}
+
+	return savestream(ctx, source, size, filepath, decompressor, options)
+}
+
+// fetchdata decodes a data URL, as described in RFC 2397.
+func fetchdata(ctx context.Context, u *url.URL) (io.ReadCloser, int64, error) {
+	header, encoded, found := strings.Cut(u.Opaque, ",")
+	if !found {
+		return nil, 0, errors.New("invalid data URL: missing comma")
+	}
+
+	var (
+		data []byte
+		err  error
+	)
+	if strings.HasSuffix(header, ";base64") {
+		unescaped, unescapeerr := url.PathUnescape(encoded)
+		if unescapeerr != nil {
+			return nil, 0, unescapeerr
+		}
+		data, err = base64.StdEncoding.DecodeString(unescaped)
+	} else {
+		var unescaped string
+		unescaped, err = url.PathUnescape(encoded)
+		data = []byte(unescaped)
+	}
+	if err != nil {
+		return nil, 0, fmt.Errorf("invalid data URL: %v", err)
+	}
+
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
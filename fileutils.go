@@ -1,11 +1,16 @@
 package workspace
 
 import (
+	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"io"
-	"net/http"
+	"io/fs"
+	"math/rand"
 	"os"
+	"sync"
+	"time"
 
 	"github.com/kuttiproject/kuttilog"
 )
@@ -45,7 +50,7 @@ type progressreader struct {
 func (pr *progressreader) Read(dst []byte) (int, error) {
 	n, err := pr.Reader.Read(dst)
 
-	if err == nil && pr.callback != nil {
+	if n > 0 && pr.callback != nil {
 		pr.current += int64(n)
 		pr.callback(pr.current, pr.total)
 	}
@@ -53,7 +58,53 @@ func (pr *progressreader) Read(dst []byte) (int, error) {
 	return n, err
 }
 
-func copyfile(sourcepath string, destpath string, buffersize int64, overwrite bool, progress ProgressFunc) error {
+// aggregateprogress combines progress from concurrent operations into a
+// single ProgressFunc.
+type aggregateprogress struct {
+	mu       sync.Mutex
+	current  int64
+	total    int64
+	callback ProgressFunc
+}
+
+// add adds n to the combined progress, and reports it.
+func (ap *aggregateprogress) add(n int64) {
+	ap.mu.Lock()
+	defer ap.mu.Unlock()
+
+	ap.current += n
+	if ap.callback != nil {
+		ap.callback(ap.current, ap.total)
+	}
+}
+
+// CopyOptions control the behaviour of CopyFileWithOptions.
+type CopyOptions struct {
+	// BufferSize is the size of the chunks in which the file is copied.
+	// If 0, a default size of 32 KiB is used.
+	BufferSize int64
+	// Overwrite allows an existing destination file to be replaced.
+	Overwrite bool
+	// Progress, if not nil, is called as data is copied. It reports
+	// current and total numbers as bytes.
+	Progress ProgressFunc
+	// OnProgress, if not nil, receives progress events, including rates,
+	// ETAs and changes of phase, no more often than ProgressInterval.
+	OnProgress ProgressHandler
+	// ProgressInterval is the minimum interval between events delivered to
+	// OnProgress. If 0, DefaultProgressInterval is used.
+	ProgressInterval time.Duration
+	// RateLimit, if more than 0, limits the copy to this many bytes per
+	// second. Any limit set by SetRateLimit applies in addition.
+	RateLimit int64
+	// Sync flushes the copied data to stable storage before the copy is
+	// renamed into place.
+	Sync bool
+}
+
+const defaultcopybuffersize = 32 * 1024
+
+func copyfile(sourcepath string, destpath string, options *CopyOptions) error {
 	sourceFileStat, err := os.Stat(sourcepath)
 	if err != nil {
 		return err
@@ -63,11 +114,8 @@ func copyfile(sourcepath string, destpath string, buffersize int64, overwrite bo
 		return fmt.Errorf("%s is not a regular file", sourcepath)
 	}
 
-	if !overwrite {
-		_, err = os.Stat(destpath)
-		if err == nil {
-			return fmt.Errorf("destination path %s already exists", destpath)
-		}
+	if err := checkfreespace(destpath, sourceFileStat.Size()); err != nil {
+		return err
 	}
 
 	source, err := os.Open(sourcepath)
@@ -76,124 +124,205 @@ func copyfile(sourcepath string, destpath string, buffersize int64, overwrite bo
 	}
 	defer source.Close()
 
-	destination, err := os.Create(destpath)
+	if !options.Overwrite {
+		// Fail early, rather than after copying. placecopy checks again,
+		// atomically.
+		if _, err := os.Lstat(destpath); err == nil {
+			return fmt.Errorf("destination path %s already exists", destpath)
+		}
+	}
+
+	tmpfilepath, err := copytotempfile(source, sourceFileStat.Size(), destpath, options)
 	if err != nil {
 		return err
 	}
-	defer destination.Close()
-
-	var sourcereader io.Reader
-	if progress != nil {
-		sourcereader = &progressreader{
-			source,
-			0,
-			sourceFileStat.Size(),
-			progress,
-		}
-	} else {
-		sourcereader = source
+	if err := placecopy(tmpfilepath, destpath, options.Overwrite); err != nil {
+		os.Remove(tmpfilepath)
+		return err
 	}
 
-	kuttilog.Printf(kuttilog.Debug, "Copying %s to %s:\n", sourcepath, destpath)
+	kuttilog.Printf(kuttilog.Debug, "Copied %s to %s.", sourcepath, destpath)
 
-	buf := make([]byte, buffersize)
-	for {
-		n, err := sourcereader.Read(buf)
-		if err != nil && err != io.EOF {
-			return err
-		}
-		if n == 0 && err == io.EOF {
-			break
-		}
+	return nil
+}
 
-		if _, err := destination.Write(buf[:n]); err != nil {
-			return err
-		}
+// placecopy moves a completed copy from a temporary file to destpath. If
+// overwrite is false, an existing file at destpath is never replaced: the
+// copy is hard linked into place, which fails atomically if destpath
+// exists, and the temporary file then removed. Where hard links are not
+// supported, destpath is claimed by creating it exclusively, and the copy
+// renamed over the claim.
+func placecopy(tmpfilepath string, destpath string, overwrite bool) error {
+	if overwrite {
+		return os.Rename(tmpfilepath, destpath)
 	}
 
-	return err
-}
+	err := os.Link(tmpfilepath, destpath)
+	if err == nil {
+		os.Remove(tmpfilepath)
+		return nil
+	}
+	if os.IsExist(err) {
+		return fmt.Errorf("destination path %s already exists", destpath)
+	}
+	if !errors.Is(err, errors.ErrUnsupported) && !errors.Is(err, fs.ErrPermission) {
+		return err
+	}
+
+	kuttilog.Printf(kuttilog.Debug, "Could not link %s into place: %v. Renaming instead.", tmpfilepath, err)
 
-func downloadfile(url string, filepath string, progress ProgressFunc) error {
-	kuttilog.Printf(kuttilog.Debug, "Connecting to %s...", url)
-	resp, err := http.Get(url)
+	claim, err := os.OpenFile(destpath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0666)
+	if os.IsExist(err) {
+		return fmt.Errorf("destination path %s already exists", destpath)
+	}
 	if err != nil {
 		return err
 	}
-	defer resp.Body.Close()
+	claim.Close()
 
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("HTTP client returned the status: %v:%v", resp.StatusCode, resp.Status)
+	if err := os.Rename(tmpfilepath, destpath); err != nil {
+		os.Remove(destpath)
+		return err
 	}
 
-	tmpfilepath := filepath + ".download"
-	out, err := os.Create(tmpfilepath)
+	return nil
+}
+
+// copytotempfile copies data into a new temporary file in the same directory
+// as destpath, and returns its path. If the copy fails, the temporary file
+// is removed.
+func copytotempfile(source io.Reader, size int64, destpath string, options *CopyOptions) (string, error) {
+	destination, err := createcopytempfile(destpath)
 	if err != nil {
-		return err
+		return "", err
 	}
+	tmpfilepath := destination.Name()
+
+	reservespace(destination, size)
 
-	var respreader io.Reader
-	if progress != nil {
-		respreader = &progressreader{
-			resp.Body,
+	sourcereader := withratelimits(
+		context.Background(),
+		source,
+		ratelimiters(NewRateLimiter(options.RateLimit)),
+	)
+	if options.Progress != nil {
+		sourcereader = &progressreader{
+			sourcereader,
 			0,
-			resp.ContentLength,
-			progress,
+			size,
+			options.Progress,
 		}
-	} else {
-		respreader = resp.Body
 	}
 
-	if _, err = io.Copy(out, respreader); err != nil {
-		out.Close()
-		return err
+	kuttilog.Printf(kuttilog.Debug, "Copying to temporary file %s:\n", tmpfilepath)
+
+	buf := make([]byte, options.BufferSize)
+	copied := int64(0)
+	for {
+		var n int
+		n, err = sourcereader.Read(buf)
+		if err != nil && err != io.EOF {
+			break
+		}
+		if n == 0 && err == io.EOF {
+			err = nil
+			if copied < size {
+				err = fmt.Errorf("source shrank while being copied: copied %v of %v bytes", copied, size)
+			}
+			break
+		}
+
+		if _, err = destination.Write(buf[:n]); err != nil {
+			break
+		}
+		copied += int64(n)
 	}
 
-	err = out.Close()
+	if err == nil && options.Sync {
+		err = destination.Sync()
+	}
+	if closeerr := destination.Close(); err == nil {
+		err = closeerr
+	}
 	if err != nil {
-		return err
+		os.Remove(tmpfilepath)
+		return "", err
 	}
 
-	kuttilog.Printf(kuttilog.Debug, "Saved to temporary file %v.", tmpfilepath)
+	return tmpfilepath, nil
+}
 
-	// Check and remove destination path if it exists
-	// Windows may cause a problem otherwise
-	_, err = os.Stat(filepath)
-	if err == nil {
-		os.RemoveAll(filepath)
-	}
+// createcopytempfile creates a uniquely named temporary file next to
+// destpath, with the same default permissions as os.Create.
+func createcopytempfile(destpath string) (*os.File, error) {
+	for attempt := 0; ; attempt++ {
+		tmpfilepath := fmt.Sprintf("%s.%08x.copy", destpath, rand.Uint32())
+		file, err := os.OpenFile(tmpfilepath, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0666)
+		if os.IsExist(err) && attempt < 100 {
+			continue
+		}
 
-	if err = os.Rename(tmpfilepath, filepath); err != nil {
-		return err
+		return file, err
 	}
-
-	kuttilog.Printf(kuttilog.Debug, "Downloaded to file %v.", filepath)
-
-	return nil
 }
 
-// CopyFile copies a file in chunks of the specified size.
+// CopyFile copies a file in chunks of the specified size. The data is
+// written to a temporary file next to the destination, which is renamed
+// into place only if the copy succeeds, so that a failed copy leaves any
+// existing destination file untouched.
 func CopyFile(sourcepath string, destpath string, buffersize int64, overwrite bool) error {
-	return copyfile(sourcepath, destpath, buffersize, overwrite, nil)
+	return copyfile(sourcepath, destpath, &CopyOptions{
+		BufferSize: buffersize,
+		Overwrite:  overwrite,
+	})
 }
 
 // CopyFileWithProgress copies a file in chunks of the specified size,
 // and reports progress via the supplied callback. The progress callback
 // reports current and  total numbers as bytes.
 func CopyFileWithProgress(sourcepath string, destpath string, buffersize int64, overwrite bool, progress ProgressFunc) error {
-	return copyfile(sourcepath, destpath, buffersize, overwrite, progress)
+	return copyfile(sourcepath, destpath, &CopyOptions{
+		BufferSize: buffersize,
+		Overwrite:  overwrite,
+		Progress:   progress,
+	})
+}
+
+// CopyFileWithOptions copies a file, as specified by the options. If options
+// is nil, defaults are used.
+func CopyFileWithOptions(sourcepath string, destpath string, options *CopyOptions) error {
+	copyoptions := CopyOptions{}
+	if options != nil {
+		copyoptions = *options
+	}
+	if copyoptions.BufferSize <= 0 {
+		copyoptions.BufferSize = defaultcopybuffersize
+	}
+
+	var tracker *progresstracker
+	if copyoptions.OnProgress != nil {
+		tracker = newprogresstracker(copyoptions.OnProgress, copyoptions.ProgressInterval)
+		copyoptions.Progress = combineprogress(copyoptions.Progress, tracker.update)
+	}
+
+	err := copyfile(sourcepath, destpath, &copyoptions)
+	if err == nil {
+		tracker.setphase(PhaseDone)
+	}
+
+	return err
 }
 
-// DownloadFile downloads a file from a url.
+// DownloadFile downloads a file from a url, using the default Downloader.
 func DownloadFile(url string, filepath string) error {
-	return downloadfile(url, filepath, nil)
+	return DefaultDownloader().DownloadFile(url, filepath)
 }
 
 // DownloadFileWithProgress downloads a file from a url and reports progress
-// via the supplied callback. The progress callback reports current and total
-// numbers as bytes.
+// via the supplied callback, using the default Downloader. The progress
+// callback reports current and total numbers as bytes.
 func DownloadFileWithProgress(url string, filepath string, progress ProgressFunc) error {
-	return downloadfile(url, filepath, progress)
+	return DefaultDownloader().DownloadFileWithProgress(url, filepath, progress)
 }
 
 // RemoveFile deletes a file.
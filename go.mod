@@ -2,4 +2,11 @@ module github.com/kuttiproject/workspace
 
 go 1.22
 
-require github.com/kuttiproject/kuttilog v0.2.1
+require (
+	github.com/klauspost/compress v1.18.0
+	github.com/kuttiproject/kuttilog v0.2.1
+	github.com/ulikunitz/xz v0.5.15
+	golang.org/x/crypto v0.33.0
+)
+
+require golang.org/x/sys v0.30.0 // indirect
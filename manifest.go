@@ -0,0 +1,223 @@
+package workspace
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// ErrManifestEntryNotFound is returned when a checksum manifest has no
+// entry for a file.
+var ErrManifestEntryNotFound = errors.New("checksum manifest has no entry for file")
+
+// ManifestSyntaxError is returned when a line in a checksum manifest
+// cannot be parsed.
+type ManifestSyntaxError struct {
+	// Line is the line number, counting from 1.
+	Line int
+	// Text is the text of the line.
+	Text string
+}
+
+func (mse *ManifestSyntaxError) Error() string {
+	return fmt.Sprintf("malformed checksum manifest line %v: '%s'", mse.Line, mse.Text)
+}
+
+// ChecksumManifest holds the entries of a checksum manifest file, such as
+// the SHA256SUMS files published alongside many downloads.
+type ChecksumManifest struct {
+	entries map[string]Digest
+}
+
+// ParseChecksumManifest parses a checksum manifest. Both the GNU coreutils
+// format ("checksum  filename", or "checksum *filename" for binary mode) and
+// the BSD format ("SHA256 (filename) = checksum") are supported. For the GNU
+// format, the algorithm is inferred from the length of the checksum. Blank
+// lines and lines starting with # are ignored.
+func ParseChecksumManifest(r io.Reader) (*ChecksumManifest, error) {
+	result := &ChecksumManifest{entries: map[string]Digest{}}
+
+	scanner := bufio.NewScanner(r)
+	linenumber := 0
+	for scanner.Scan() {
+		linenumber++
+		line := strings.TrimRight(scanner.Text(), "\r")
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		filename, digest, ok := parsemanifestline(line)
+		if !ok {
+			return nil, &ManifestSyntaxError{Line: linenumber, Text: line}
+		}
+
+		result.entries[manifestkey(filename)] = digest
+	}
+
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return result, nil
+}
+
+func parsemanifestline(line string) (string, Digest, bool) {
+	// BSD format: ALGORITHM (filename) = checksum
+	if algorithm, rest, found := strings.Cut(line, " ("); found && !strings.Contains(algorithm, " ") {
+		if filename, value, found := strings.Cut(rest, ") = "); found {
+			digest, err := ParseDigest(algorithm + ":" + strings.TrimSpace(value))
+			return filename, digest, err == nil
+		}
+	}
+
+	// GNU format: checksum, space, then space or asterisk, then filename.
+	// A leading backslash means that the filename has escapes.
+	escaped := strings.HasPrefix(line, "\\")
+	if escaped {
+		line = line[1:]
+	}
+
+	value, rest, found := strings.Cut(line, " ")
+	if !found || len(rest) < 2 || (rest[0] != ' ' && rest[0] != '*') {
+		return "", Digest{}, false
+	}
+
+	digest, err := ParseDigest(value)
+	if err != nil {
+		return "", Digest{}, false
+	}
+
+	filename := rest[1:]
+	if escaped {
+		filename = strings.NewReplacer(`\\`, `\`, `\n`, "\n", `\r`, "\r").Replace(filename)
+	}
+
+	return filename, digest, true
+}
+
+func manifestkey(filename string) string {
+	return strings.TrimPrefix(filepath.ToSlash(filename), "./")
+}
+
+// LoadChecksumManifest reads a checksum manifest from a local file, or
+// downloads it if source is an http or https URL.
+func LoadChecksumManifest(ctx context.Context, source string) (*ChecksumManifest, error) {
+	return loadchecksummanifest(ctx, source, "")
+}
+
+// LoadSignedChecksumManifest reads a checksum manifest like
+// LoadChecksumManifest, and checks it against a minisign signature, read
+// from a local file or URL. The signature must be valid, and made by one
+// of the workspace's trusted keys.
+func LoadSignedChecksumManifest(ctx context.Context, source string, signature string) (*ChecksumManifest, error) {
+	if signature == "" {
+		return nil, errors.New("signature location must not be empty")
+	}
+
+	return loadchecksummanifest(ctx, source, signature)
+}
+
+func loadchecksummanifest(ctx context.Context, source string, signature string) (*ChecksumManifest, error) {
+	if !strings.HasPrefix(source, "http://") && !strings.HasPrefix(source, "https://") {
+		if signature != "" {
+			signaturedata, err := DefaultDownloader().fetchsignature(ctx, signature)
+			if err != nil {
+				return nil, err
+			}
+
+			err = VerifySignature(source, signaturedata)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		f, err := os.Open(source)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+
+		return ParseChecksumManifest(f)
+	}
+
+	tmpfile, err := os.CreateTemp("", "kutti-manifest-*")
+	if err != nil {
+		return nil, err
+	}
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+
+	err = DownloadFileContext(ctx, source, tmpfile.Name(), &DownloadOptions{Signature: signature})
+	if err != nil {
+		return nil, err
+	}
+
+	return loadchecksummanifest(ctx, tmpfile.Name(), "")
+}
+
+// Lookup returns the digest recorded for a filename. If there is no such
+// entry, ErrManifestEntryNotFound is returned.
+func (cm *ChecksumManifest) Lookup(filename string) (Digest, error) {
+	digest, ok := cm.entries[manifestkey(filename)]
+	if !ok {
+		return Digest{}, fmt.Errorf("%w: %s", ErrManifestEntryNotFound, filename)
+	}
+
+	return digest, nil
+}
+
+// VerifyFile checks a local file against the manifest entry for a filename.
+// If filename is empty, the base name of the file path is used. A mismatch
+// is reported as a *ChecksumMismatchError.
+func (cm *ChecksumManifest) VerifyFile(filepath string, filename string) error {
+	if filename == "" {
+		filename = path.Base(strings.ReplaceAll(filepath, "\\", "/"))
+	}
+
+	digest, err := cm.Lookup(filename)
+	if err != nil {
+		return err
+	}
+
+	verifier, err := newdigestverifier(digest)
+	if err != nil {
+		return err
+	}
+
+	err = verifier.addfile(filepath)
+	if err != nil {
+		return err
+	}
+
+	return verifier.verify(filepath)
+}
+
+// DownloadFile downloads a file from a url, verifying it against the
+// manifest entry for the last element of the url's path while downloading.
+// The options parameter can be nil.
+func (cm *ChecksumManifest) DownloadFile(ctx context.Context, rawurl string, filepath string, options *DownloadOptions) error {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return err
+	}
+
+	digest, err := cm.Lookup(path.Base(u.Path))
+	if err != nil {
+		return err
+	}
+
+	verifiedoptions := DownloadOptions{}
+	if options != nil {
+		verifiedoptions = *options
+	}
+	verifiedoptions.Checksum = digest
+
+	return DownloadFileContext(ctx, rawurl, filepath, &verifiedoptions)
+}
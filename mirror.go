@@ -0,0 +1,178 @@
+package workspace
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/kuttiproject/kuttilog"
+)
+
+var (
+	mirrorlock sync.RWMutex
+	mirrors    []string
+	offline    = false
+)
+
+// OfflineError is returned when a file has to be fetched from the network
+// in offline mode.
+type OfflineError struct {
+	URL string
+}
+
+func (oe *OfflineError) Error() string {
+	return fmt.Sprintf("offline mode: %s is not available in any mirror", oe.URL)
+}
+
+// SetMirrors sets local mirror directories, to be consulted in the order
+// specified before fetching files from the network. Each mirror can be
+// specified as a local directory path, or a file:// URL. Calling SetMirrors
+// with no parameters clears the mirrors.
+//
+// A URL is mapped to a file in a mirror by its host and path. For example,
+// https://example.com/images/node.img maps to example.com/images/node.img
+// under each mirror directory.
+func SetMirrors(roots ...string) error {
+	result := make([]string, 0, len(roots))
+	for _, root := range roots {
+		rootpath, err := mirrorrootpath(root)
+		if err != nil {
+			return err
+		}
+
+		dirinfo, err := os.Stat(rootpath)
+		if err != nil {
+			return err
+		}
+		if !dirinfo.IsDir() {
+			return fmt.Errorf("mirror %s is not a directory", root)
+		}
+
+		result = append(result, rootpath)
+	}
+
+	mirrorlock.Lock()
+	defer mirrorlock.Unlock()
+
+	mirrors = result
+	return nil
+}
+
+// Mirrors returns the current mirror directories.
+func Mirrors() []string {
+	mirrorlock.RLock()
+	defer mirrorlock.RUnlock()
+
+	return append([]string(nil), mirrors...)
+}
+
+// SetOffline sets or clears offline mode. In offline mode, files can only
+// come from mirrors, and any attempt to fetch from the network fails with
+// an *OfflineError.
+func SetOffline(value bool) {
+	mirrorlock.Lock()
+	defer mirrorlock.Unlock()
+
+	offline = value
+}
+
+// Offline returns true if offline mode is set.
+func Offline() bool {
+	mirrorlock.RLock()
+	defer mirrorlock.RUnlock()
+
+	return offline
+}
+
+// MirrorPath returns the path where the file for the specified URL would
+// reside under a mirror directory.
+func MirrorPath(root string, rawurl string) (string, error) {
+	rootpath, err := mirrorrootpath(root)
+	if err != nil {
+		return "", err
+	}
+
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return "", err
+	}
+	if u.Host == "" {
+		return "", fmt.Errorf("URL %s has no host", rawurl)
+	}
+
+	urlpath := path.Clean("/" + u.Path)
+	if urlpath == "/" {
+		return "", fmt.Errorf("URL %s has no path", rawurl)
+	}
+
+	// Ports are separated by colons, which cannot be used in paths
+	// on Windows.
+	host := strings.ReplaceAll(u.Host, ":", "_")
+	return filepath.Join(rootpath, host, filepath.FromSlash(urlpath)), nil
+}
+
+// PopulateMirror fetches the specified URLs from the network into a
+// mirror directory. URLs whose files are already in the mirror are
+// skipped.
+func PopulateMirror(root string, urls ...string) error {
+	for _, rawurl := range urls {
+		mirroredpath, err := MirrorPath(root, rawurl)
+		if err != nil {
+			return err
+		}
+
+		if _, err := os.Stat(mirroredpath); err == nil {
+			kuttilog.Printf(kuttilog.Verbose, "%s is already mirrored.", rawurl)
+			continue
+		}
+
+		err = os.MkdirAll(filepath.Dir(mirroredpath), 0755)
+		if err != nil {
+			return err
+		}
+
+		kuttilog.Printf(kuttilog.Info, "Mirroring %s...", rawurl)
+		err = DefaultDownloader().httpdownloadfile(context.Background(), rawurl, mirroredpath, &DownloadOptions{})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// findinmirrors returns the path of the file for the specified URL in the
+// first mirror that has it.
+func findinmirrors(rawurl string) (string, bool) {
+	for _, root := range Mirrors() {
+		mirroredpath, err := MirrorPath(root, rawurl)
+		if err != nil {
+			return "", false
+		}
+
+		fileinfo, err := os.Stat(mirroredpath)
+		if err == nil && fileinfo.Mode().IsRegular() {
+			return mirroredpath, true
+		}
+	}
+
+	return "", false
+}
+
+func mirrorrootpath(root string) (string, error) {
+	if !strings.HasPrefix(root, "file:") {
+		return root, nil
+	}
+
+	u, err := url.Parse(root)
+	if err != nil {
+		return "", err
+	}
+
+	return fileurlpath(u)
+}
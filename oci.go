@@ -0,0 +1,423 @@
+package workspace
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"runtime"
+	"strings"
+
+	"github.com/kuttiproject/kuttilog"
+)
+
+const (
+	ocimanifestmediatype        = "application/vnd.oci.image.manifest.v1+json"
+	ociindexmediatype           = "application/vnd.oci.image.index.v1+json"
+	dockermanifestmediatype     = "application/vnd.docker.distribution.manifest.v2+json"
+	dockermanifestlistmediatype = "application/vnd.docker.distribution.manifest.list.v2+json"
+	ocititleannotation          = "org.opencontainers.image.title"
+	maxocimanifestsize          = 4 << 20
+)
+
+// OCIReference identifies an artifact in an OCI registry.
+type OCIReference struct {
+	// Registry is the host, and optionally port, of the registry.
+	Registry string
+	// Repository is the path of the repository within the registry.
+	Repository string
+	// Tag is the tag of the artifact, if Digest is not specified.
+	Tag string
+	// Digest, if not empty, is the digest of the artifact's manifest.
+	Digest string
+}
+
+// ParseOCIReference parses a reference of the form registry/repository:tag
+// or registry/repository@digest. If neither tag nor digest is specified, the
+// tag "latest" is used.
+func ParseOCIReference(reference string) (*OCIReference, error) {
+	registry, repository, found := strings.Cut(reference, "/")
+	if !found || registry == "" || repository == "" {
+		return nil, fmt.Errorf("invalid OCI reference %s: must be registry/repository:tag or registry/repository@digest", reference)
+	}
+
+	result := &OCIReference{Registry: registry, Tag: "latest"}
+	if name, digest, found := strings.Cut(repository, "@"); found {
+		if _, err := ParseDigest(digest); err != nil {
+			return nil, fmt.Errorf("invalid OCI reference %s: %v", reference, err)
+		}
+		repository, result.Digest, result.Tag = name, digest, ""
+	} else if i := strings.LastIndex(repository, ":"); i >= 0 {
+		repository, result.Tag = repository[:i], repository[i+1:]
+	}
+
+	if repository == "" || strings.ToLower(repository) != repository {
+		return nil, fmt.Errorf("invalid OCI reference %s: repository must be lowercase", reference)
+	}
+	result.Repository = repository
+
+	return result, nil
+}
+
+func (or *OCIReference) String() string {
+	if or.Digest != "" {
+		return or.Registry + "/" + or.Repository + "@" + or.Digest
+	}
+
+	return or.Registry + "/" + or.Repository + ":" + or.Tag
+}
+
+// RegistryCredential holds credentials for an OCI registry.
+type RegistryCredential struct {
+	// Username and Password are used to obtain tokens from the registry's
+	// token service, or for basic authentication.
+	Username string
+	Password string
+	// Token, if not empty, is sent as a bearer token, instead of obtaining
+	// one from the token service.
+	Token string
+}
+
+type ocidescriptor struct {
+	MediaType   string            `json:"mediaType"`
+	Digest      string            `json:"digest"`
+	Size        int64             `json:"size"`
+	Annotations map[string]string `json:"annotations,omitempty"`
+	Platform    *struct {
+		OS           string `json:"os"`
+		Architecture string `json:"architecture"`
+	} `json:"platform,omitempty"`
+}
+
+type ocimanifest struct {
+	MediaType string          `json:"mediaType"`
+	Manifests []ocidescriptor `json:"manifests"`
+	Layers    []ocidescriptor `json:"layers"`
+}
+
+// ociclient makes authenticated requests to a registry for a repository.
+type ociclient struct {
+	downloader *Downloader
+	ref        *OCIReference
+	base       string
+	credential RegistryCredential
+	token      string
+}
+
+// fetchoci fetches a layer of an OCI artifact, for URLs of the form
+// oci://registry/repository:tag or oci://registry/repository@digest.
+//
+// A layer is chosen by the query parameter "file", which matches its title
+// annotation, or "mediatype", which matches its media type. If neither is
+// specified, the artifact must have a single layer. For multi-platform
+// artifacts, the query parameter "platform", such as linux/arm64, chooses
+// the platform. It defaults to the current one.
+func (d *Downloader) fetchoci(ctx context.Context, u *url.URL) (io.ReadCloser, int64, error) {
+	ref, err := ParseOCIReference(u.Host + u.Path)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	client := &ociclient{
+		downloader: d,
+		ref:        ref,
+		base:       registrybaseurl(ref.Registry),
+		credential: d.RegistryCredentials[ref.Registry],
+	}
+	client.token = client.credential.Token
+
+	query := u.Query()
+	platform := query.Get("platform")
+	if platform == "" {
+		platform = runtime.GOOS + "/" + runtime.GOARCH
+	}
+
+	manifestref := ref.Digest
+	if manifestref == "" {
+		manifestref = ref.Tag
+	}
+	manifest, err := client.manifest(ctx, manifestref, ref.Digest)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if len(manifest.Manifests) > 0 {
+		chosen, err := choosemanifest(manifest.Manifests, platform)
+		if err != nil {
+			return nil, 0, fmt.Errorf("%s: %w", ref, err)
+		}
+		manifest, err = client.manifest(ctx, chosen.Digest, chosen.Digest)
+		if err != nil {
+			return nil, 0, err
+		}
+	}
+
+	layer, err := chooselayer(manifest.Layers, query.Get("file"), query.Get("mediatype"))
+	if err != nil {
+		return nil, 0, fmt.Errorf("%s: %w", ref, err)
+	}
+
+	digest, err := ParseDigest(layer.Digest)
+	if err != nil {
+		return nil, 0, err
+	}
+	verifier, err := newdigestverifier(digest)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	kuttilog.Printf(kuttilog.Debug, "Fetching layer %s of %s...", layer.Digest, ref)
+	resp, err := client.get(ctx, "/blobs/"+layer.Digest, "")
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &verifiedreader{
+		ReadCloser: resp.Body,
+		verifier:   verifier,
+		name:       ref.String() + " layer " + layer.Digest,
+	}, layer.Size, nil
+}
+
+// registrybaseurl returns the base URL of a registry's API. Registries on
+// the loopback interface are accessed over plain HTTP.
+func registrybaseurl(registry string) string {
+	host := registry
+	if h, _, err := net.SplitHostPort(registry); err == nil {
+		host = h
+	}
+
+	scheme := "https"
+	if ip := net.ParseIP(host); host == "localhost" || (ip != nil && ip.IsLoopback()) {
+		scheme = "http"
+	}
+
+	return scheme + "://" + registry + "/v2/"
+}
+
+// manifest fetches a manifest or index. If digest is not empty, the
+// manifest is verified against it.
+func (oc *ociclient) manifest(ctx context.Context, reference string, digest string) (*ocimanifest, error) {
+	accept := strings.Join([]string{
+		ocimanifestmediatype,
+		ociindexmediatype,
+		dockermanifestmediatype,
+		dockermanifestlistmediatype,
+	}, ", ")
+
+	resp, err := oc.get(ctx, "/manifests/"+reference, accept)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxocimanifestsize))
+	if err != nil {
+		return nil, err
+	}
+
+	if digest != "" {
+		expected, err := ParseDigest(digest)
+		if err != nil {
+			return nil, err
+		}
+		verifier, err := newdigestverifier(expected)
+		if err != nil {
+			return nil, err
+		}
+		verifier.Write(data)
+		if err := verifier.verify(oc.ref.Repository + "@" + digest); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &ocimanifest{}
+	if err := json.Unmarshal(data, result); err != nil {
+		return nil, fmt.Errorf("invalid manifest for %s: %v", oc.ref, err)
+	}
+
+	return result, nil
+}
+
+// get sends a GET request for a path under the repository, obtaining a
+// token and retrying once if the registry asks for authentication.
+func (oc *ociclient) get(ctx context.Context, path string, accept string) (*http.Response, error) {
+	requesturl := oc.base + oc.ref.Repository + path
+
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, requesturl, nil)
+		if err != nil {
+			return nil, err
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if oc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+oc.token)
+		} else if oc.credential.Username != "" {
+			req.SetBasicAuth(oc.credential.Username, oc.credential.Password)
+		}
+
+		resp, err := oc.downloader.do(req)
+		if err != nil {
+			return nil, err
+		}
+		if resp.StatusCode == http.StatusOK {
+			return resp, nil
+		}
+
+		challenge := resp.Header.Get("WWW-Authenticate")
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusUnauthorized || attempt > 0 || oc.credential.Token != "" {
+			return nil, newhttpstatuserror(resp)
+		}
+
+		if err := oc.authenticate(ctx, challenge); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// authenticate obtains a token from the service named in a Bearer
+// challenge. Basic challenges are answered with the stored credentials.
+func (oc *ociclient) authenticate(ctx context.Context, challenge string) error {
+	scheme, params := parsechallenge(challenge)
+	if strings.EqualFold(scheme, "basic") {
+		if oc.credential.Username == "" {
+			return fmt.Errorf("registry %s requires credentials", oc.ref.Registry)
+		}
+		return nil
+	}
+	if !strings.EqualFold(scheme, "bearer") || params["realm"] == "" {
+		return fmt.Errorf("registry %s sent an unsupported authentication challenge: %s", oc.ref.Registry, challenge)
+	}
+
+	tokenurl, err := url.Parse(params["realm"])
+	if err != nil {
+		return err
+	}
+	query := tokenurl.Query()
+	if params["service"] != "" {
+		query.Set("service", params["service"])
+	}
+	scope := params["scope"]
+	if scope == "" {
+		scope = "repository:" + oc.ref.Repository + ":pull"
+	}
+	query.Set("scope", scope)
+	tokenurl.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, tokenurl.String(), nil)
+	if err != nil {
+		return err
+	}
+	if oc.credential.Username != "" {
+		req.SetBasicAuth(oc.credential.Username, oc.credential.Password)
+	}
+
+	kuttilog.Printf(kuttilog.Debug, "Obtaining token for %s from %s...", oc.ref, params["realm"])
+	resp, err := oc.downloader.send(req, oc.downloader.client())
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return newhttpstatuserror(resp)
+	}
+
+	var tokenresponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenresponse); err != nil {
+		return fmt.Errorf("invalid token response from %s: %v", params["realm"], err)
+	}
+
+	oc.token = tokenresponse.Token
+	if oc.token == "" {
+		oc.token = tokenresponse.AccessToken
+	}
+	if oc.token == "" {
+		return fmt.Errorf("no token received from %s", params["realm"])
+	}
+
+	return nil
+}
+
+// parsechallenge parses a WWW-Authenticate header of the form
+// Bearer realm="...",service="...",scope="...".
+func parsechallenge(challenge string) (string, map[string]string) {
+	scheme, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	params := map[string]string{}
+
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		params[strings.ToLower(strings.TrimSpace(key))] = value
+	}
+
+	return scheme, params
+}
+
+// choosemanifest chooses the manifest for a platform from an index.
+func choosemanifest(manifests []ocidescriptor, platform string) (*ocidescriptor, error) {
+	if len(manifests) == 1 {
+		return &manifests[0], nil
+	}
+
+	for i, manifest := range manifests {
+		if manifest.Platform != nil &&
+			manifest.Platform.OS+"/"+manifest.Platform.Architecture == platform {
+			return &manifests[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no manifest for platform %s", platform)
+}
+
+// chooselayer chooses a layer by title or media type, or the only layer.
+func chooselayer(layers []ocidescriptor, title string, mediatype string) (*ocidescriptor, error) {
+	if title == "" && mediatype == "" {
+		if len(layers) != 1 {
+			return nil, fmt.Errorf("artifact has %v layers: specify one using the file or mediatype parameters", len(layers))
+		}
+		return &layers[0], nil
+	}
+
+	for i, layer := range layers {
+		if (title == "" || layer.Annotations[ocititleannotation] == title) &&
+			(mediatype == "" || layer.MediaType == mediatype) {
+			return &layers[i], nil
+		}
+	}
+
+	return nil, fmt.Errorf("no layer matches file %q and media type %q", title, mediatype)
+}
+
+// verifiedreader checks data against a digest as it is read, and fails at
+// the end of the data if it does not match.
+type verifiedreader struct {
+	io.ReadCloser
+	verifier *digestverifier
+	name     string
+}
+
+func (vr *verifiedreader) Read(dst []byte) (int, error) {
+	n, err := vr.ReadCloser.Read(dst)
+	vr.verifier.Write(dst[:n])
+	if err == io.EOF {
+		if verifyerr := vr.verifier.verify(vr.name); verifyerr != nil {
+			return n, verifyerr
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,16 @@
+//go:build linux
+
+package workspace
+
+import (
+	"os"
+	"syscall"
+)
+
+// fallocatekeepsize is FALLOC_FL_KEEP_SIZE, which allocates space without
+// changing the file's size.
+const fallocatekeepsize = 0x1
+
+func preallocate(f *os.File, size int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocatekeepsize, 0, size)
+}
@@ -0,0 +1,184 @@
+package workspace
+
+import (
+	"sync"
+	"time"
+)
+
+// DefaultProgressInterval is the default minimum interval between progress
+// events.
+const DefaultProgressInterval = 100 * time.Millisecond
+
+// ProgressPhase is the stage an operation has reached.
+type ProgressPhase string
+
+const (
+	// PhaseConnecting means the source is being contacted.
+	PhaseConnecting ProgressPhase = "connecting"
+	// PhaseTransferring means data is being transferred.
+	PhaseTransferring ProgressPhase = "transferring"
+	// PhaseVerifying means the data is being checked against a checksum or
+	// signature.
+	PhaseVerifying ProgressPhase = "verifying"
+	// PhaseRenaming means the data is being moved to its destination.
+	PhaseRenaming ProgressPhase = "renaming"
+	// PhaseDone means the operation has completed successfully.
+	PhaseDone ProgressPhase = "done"
+)
+
+// ProgressEvent describes the progress of an operation.
+type ProgressEvent struct {
+	// Phase is the stage the operation has reached.
+	Phase ProgressPhase
+	// Current is the number of bytes transferred so far.
+	Current int64
+	// Total is the total number of bytes to be transferred, or 0 if it is
+	// not known.
+	Total int64
+	// Rate is the recent transfer rate, in bytes per second.
+	Rate float64
+	// AverageRate is the transfer rate since the operation started, in
+	// bytes per second.
+	AverageRate float64
+	// ETA is the estimated time remaining, or 0 if it cannot be estimated.
+	ETA time.Duration
+	// Elapsed is the time since the operation started.
+	Elapsed time.Duration
+}
+
+// ProgressHandler is a callback that receives progress events.
+type ProgressHandler func(event ProgressEvent)
+
+// ProgressEvents adapts a ProgressHandler to a ProgressFunc, so that it can
+// be used with functions like CopyFileWithProgress. The returned ProgressFunc
+// computes transfer rates and ETAs, and delivers events in PhaseTransferring
+// no more often than the specified interval. If interval is 0,
+// DefaultProgressInterval is used. The first event, and events where the
+// total has been reached, are always delivered.
+func ProgressEvents(handler ProgressHandler, interval time.Duration) ProgressFunc {
+	return newprogresstracker(handler, interval).update
+}
+
+// progresstracker turns progress updates and phase changes into throttled
+// progress events.
+type progresstracker struct {
+	mu          sync.Mutex
+	handler     ProgressHandler
+	interval    time.Duration
+	start       time.Time
+	phase       ProgressPhase
+	current     int64
+	total       int64
+	emitted     bool
+	lastemit    time.Time
+	lastcurrent int64
+	rate        float64
+}
+
+func newprogresstracker(handler ProgressHandler, interval time.Duration) *progresstracker {
+	if interval <= 0 {
+		interval = DefaultProgressInterval
+	}
+
+	return &progresstracker{
+		handler:  handler,
+		interval: interval,
+		start:    time.Now(),
+		phase:    PhaseTransferring,
+	}
+}
+
+// update records transfer progress, and delivers an event if enough time
+// has passed since the last one.
+func (pt *progresstracker) update(current int64, total int64) {
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	if total < 0 {
+		total = 0
+	}
+	pt.current, pt.total = current, total
+	if pt.phase == PhaseConnecting {
+		pt.phase = PhaseTransferring
+	}
+
+	now := time.Now()
+	finished := total > 0 && current >= total
+	if pt.emitted && !finished && now.Sub(pt.lastemit) < pt.interval {
+		return
+	}
+
+	pt.emit(now)
+}
+
+// setphase moves to a new phase, and delivers an event immediately. It
+// does nothing on a nil tracker.
+func (pt *progresstracker) setphase(phase ProgressPhase) {
+	if pt == nil {
+		return
+	}
+
+	pt.mu.Lock()
+	defer pt.mu.Unlock()
+
+	pt.phase = phase
+	pt.emit(time.Now())
+}
+
+// emit delivers an event. The caller must hold pt.mu.
+func (pt *progresstracker) emit(now time.Time) {
+	elapsed := now.Sub(pt.start)
+
+	if pt.emitted {
+		if seconds := now.Sub(pt.lastemit).Seconds(); seconds > 0 {
+			instant := float64(pt.current-pt.lastcurrent) / seconds
+			if pt.rate == 0 {
+				pt.rate = instant
+			} else {
+				// Smooth the rate, so that it does not jump about.
+				pt.rate = 0.3*instant + 0.7*pt.rate
+			}
+		}
+	}
+
+	event := ProgressEvent{
+		Phase:   pt.phase,
+		Current: pt.current,
+		Total:   pt.total,
+		Rate:    pt.rate,
+		Elapsed: elapsed,
+	}
+	if elapsed > 0 {
+		event.AverageRate = float64(pt.current) / elapsed.Seconds()
+	}
+
+	rate := event.Rate
+	if rate <= 0 {
+		rate = event.AverageRate
+	}
+	if pt.total > 0 && pt.current < pt.total && rate > 0 {
+		event.ETA = time.Duration(float64(pt.total-pt.current) / rate * float64(time.Second))
+	}
+
+	pt.emitted = true
+	pt.lastemit = now
+	pt.lastcurrent = pt.current
+
+	pt.handler(event)
+}
+
+// combineprogress returns a ProgressFunc that calls both of the specified
+// ones, either of which can be nil.
+func combineprogress(first ProgressFunc, second ProgressFunc) ProgressFunc {
+	if first == nil {
+		return second
+	}
+	if second == nil {
+		return first
+	}
+
+	return func(current int64, total int64) {
+		first(current, total)
+		second(current, total)
+	}
+}
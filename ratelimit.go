@@ -0,0 +1,167 @@
+package workspace
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+)
+
+// RateLimiter limits the rate of data transfer, using a token bucket. A
+// single RateLimiter can be shared by concurrent transfers, to limit their
+// combined rate.
+type RateLimiter struct {
+	lock   sync.Mutex
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// NewRateLimiter returns a RateLimiter that allows the specified number of
+// bytes per second. If bytespersecond is 0 or less, it returns nil, which
+// means no limit.
+func NewRateLimiter(bytespersecond int64) *RateLimiter {
+	if bytespersecond <= 0 {
+		return nil
+	}
+
+	// Allowing bursts of a tenth of a second's worth of data keeps reads
+	// small, so that progress is reported smoothly.
+	burst := float64(bytespersecond) / 10
+	if burst < 512 {
+		burst = 512
+	}
+
+	return &RateLimiter{
+		rate:   float64(bytespersecond),
+		burst:  burst,
+		tokens: burst,
+		last:   time.Now(),
+	}
+}
+
+// Limit returns the allowed number of bytes per second. It returns 0 on a
+// nil RateLimiter, which means no limit.
+func (rl *RateLimiter) Limit() int64 {
+	if rl == nil {
+		return 0
+	}
+
+	return int64(rl.rate)
+}
+
+// wait takes n bytes' worth of tokens from the bucket, and waits until they
+// would have been available.
+func (rl *RateLimiter) wait(ctx context.Context, n int) error {
+	rl.lock.Lock()
+	now := time.Now()
+	rl.tokens += now.Sub(rl.last).Seconds() * rl.rate
+	if rl.tokens > rl.burst {
+		rl.tokens = rl.burst
+	}
+	rl.last = now
+	rl.tokens -= float64(n)
+	delay := time.Duration(0)
+	if rl.tokens < 0 {
+		delay = time.Duration(-rl.tokens / rl.rate * float64(time.Second))
+	}
+	rl.lock.Unlock()
+
+	if delay == 0 {
+		return nil
+	}
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+var (
+	globalratelimiterlock sync.RWMutex
+	globalratelimiter     *RateLimiter
+)
+
+// SetRateLimit limits the combined rate of all downloads and copies to the
+// specified number of bytes per second. A value of 0 removes the limit.
+func SetRateLimit(bytespersecond int64) {
+	globalratelimiterlock.Lock()
+	defer globalratelimiterlock.Unlock()
+
+	globalratelimiter = NewRateLimiter(bytespersecond)
+}
+
+// LoadWorkspaceRateLimit sets the limit on the combined rate of all
+// downloads and copies, as SetRateLimit does, to the GlobalRateLimit saved
+// in the downloader config of the current workspace.
+func LoadWorkspaceRateLimit() error {
+	config, _, err := LoadDownloaderConfig()
+	if err != nil {
+		return err
+	}
+
+	SetRateLimit(config.GlobalRateLimit)
+	return nil
+}
+
+// GlobalRateLimiter returns the RateLimiter set by SetRateLimit, or nil if
+// there is no limit.
+func GlobalRateLimiter() *RateLimiter {
+	globalratelimiterlock.RLock()
+	defer globalratelimiterlock.RUnlock()
+
+	return globalratelimiter
+}
+
+// ratelimiters returns the non-nil limiters among those specified, and the
+// global one.
+func ratelimiters(limiters ...*RateLimiter) []*RateLimiter {
+	var result []*RateLimiter
+	for _, limiter := range append(limiters, GlobalRateLimiter()) {
+		if limiter != nil {
+			result = append(result, limiter)
+		}
+	}
+	return result
+}
+
+// ratelimitedreader limits reads from a reader by one or more limiters.
+type ratelimitedreader struct {
+	io.Reader
+	ctx      context.Context
+	limiters []*RateLimiter
+}
+
+// withratelimits returns a reader limited by the specified limiters, or the
+// reader itself if there are none.
+func withratelimits(ctx context.Context, source io.Reader, limiters []*RateLimiter) io.Reader {
+	if len(limiters) == 0 {
+		return source
+	}
+
+	return &ratelimitedreader{Reader: source, ctx: ctx, limiters: limiters}
+}
+
+func (rlr *ratelimitedreader) Read(dst []byte) (int, error) {
+	for _, limiter := range rlr.limiters {
+		if burst := int(limiter.burst); len(dst) > burst {
+			dst = dst[:burst]
+		}
+	}
+
+	n, err := rlr.Reader.Read(dst)
+	if n > 0 {
+		for _, limiter := range rlr.limiters {
+			if waiterr := limiter.wait(rlr.ctx, n); waiterr != nil {
+				return n, waiterr
+			}
+		}
+	}
+
+	return n, err
+}
@@ -0,0 +1,338 @@
+package workspace
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	progressbarwidth   = 30
+	defaultloginterval = 5 * time.Second
+)
+
+// ProgressRenderer displays the progress of one or more named transfers.
+type ProgressRenderer interface {
+	// Progress returns a ProgressFunc that renders the progress of the
+	// named transfer. It can be passed to CopyFileWithProgress or
+	// DownloadFileWithProgress.
+	Progress(name string) ProgressFunc
+	// Handler returns a ProgressHandler that renders the progress of the
+	// named transfer, including changes of phase. It can be used as the
+	// OnProgress option of a download or copy.
+	Handler(name string) ProgressHandler
+	// Finish completes the output, after all transfers are done.
+	Finish()
+}
+
+// NewProgressRenderer returns a renderer suitable for the specified output.
+// If it is a terminal, progress is shown as a bar, or if concurrent is true,
+// as one bar per transfer. Otherwise, progress is logged periodically as
+// plain lines.
+func NewProgressRenderer(out *os.File, concurrent bool) ProgressRenderer {
+	if !isterminal(out) {
+		return NewLogRenderer(out, 0)
+	}
+	if concurrent {
+		return NewMultiBarRenderer(out)
+	}
+
+	return NewBarRenderer(out)
+}
+
+// isterminal reports whether a file is a character device, such as a
+// terminal.
+func isterminal(f *os.File) bool {
+	fileinfo, err := f.Stat()
+	return err == nil && fileinfo.Mode()&os.ModeCharDevice != 0
+}
+
+// BarRenderer renders progress as a single line, redrawn in place. It is
+// meant for one transfer at a time on a terminal.
+type BarRenderer struct {
+	mu    sync.Mutex
+	out   io.Writer
+	width int
+}
+
+// NewBarRenderer returns a BarRenderer that writes to out.
+func NewBarRenderer(out io.Writer) *BarRenderer {
+	return &BarRenderer{out: out}
+}
+
+// Progress implements ProgressRenderer.
+func (br *BarRenderer) Progress(name string) ProgressFunc {
+	return ProgressEvents(br.Handler(name), 0)
+}
+
+// Handler implements ProgressRenderer.
+func (br *BarRenderer) Handler(name string) ProgressHandler {
+	return func(event ProgressEvent) {
+		br.mu.Lock()
+		defer br.mu.Unlock()
+
+		line := progressline(name, event)
+		padding := ""
+		if len(line) < br.width {
+			padding = strings.Repeat(" ", br.width-len(line))
+		}
+		fmt.Fprintf(br.out, "\r%s%s", line, padding)
+		br.width = len(line)
+	}
+}
+
+// Finish implements ProgressRenderer.
+func (br *BarRenderer) Finish() {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+
+	if br.width > 0 {
+		fmt.Fprintln(br.out)
+		br.width = 0
+	}
+}
+
+// MultiBarRenderer renders progress as one line per transfer, redrawn in
+// place using ANSI escape sequences. It is meant for concurrent transfers
+// on a terminal.
+type MultiBarRenderer struct {
+	mu    sync.Mutex
+	out   io.Writer
+	names []string
+	lines map[string]string
+	drawn int
+}
+
+// NewMultiBarRenderer returns a MultiBarRenderer that writes to out.
+func NewMultiBarRenderer(out io.Writer) *MultiBarRenderer {
+	return &MultiBarRenderer{out: out, lines: map[string]string{}}
+}
+
+// Progress implements ProgressRenderer.
+func (mr *MultiBarRenderer) Progress(name string) ProgressFunc {
+	return ProgressEvents(mr.Handler(name), 0)
+}
+
+// Handler implements ProgressRenderer.
+func (mr *MultiBarRenderer) Handler(name string) ProgressHandler {
+	return func(event ProgressEvent) {
+		mr.mu.Lock()
+		defer mr.mu.Unlock()
+
+		if _, ok := mr.lines[name]; !ok {
+			mr.names = append(mr.names, name)
+		}
+		mr.lines[name] = progressline(name, event)
+
+		var sb strings.Builder
+		if mr.drawn > 0 {
+			// Move to the start of the first line drawn
+			fmt.Fprintf(&sb, "\x1b[%dA\r", mr.drawn)
+		}
+		for _, n := range mr.names {
+			fmt.Fprintf(&sb, "\x1b[2K%s\n", mr.lines[n])
+		}
+		io.WriteString(mr.out, sb.String())
+		mr.drawn = len(mr.names)
+	}
+}
+
+// Finish implements ProgressRenderer. Lines already drawn are left as is.
+func (mr *MultiBarRenderer) Finish() {
+	mr.mu.Lock()
+	defer mr.mu.Unlock()
+
+	mr.names = nil
+	mr.lines = map[string]string{}
+	mr.drawn = 0
+}
+
+// LogRenderer renders progress as plain lines, written periodically and
+// when a transfer changes phase. It is meant for output that is not a
+// terminal, such as CI logs.
+type LogRenderer struct {
+	mu        sync.Mutex
+	out       io.Writer
+	interval  time.Duration
+	transfers map[string]*loggedtransfer
+}
+
+// loggedtransfer records what has been logged about a transfer.
+type loggedtransfer struct {
+	phase    ProgressPhase
+	last     time.Time
+	finished bool
+}
+
+// NewLogRenderer returns a LogRenderer that writes to out, logging the
+// progress of each transfer no more often than interval. If interval is 0,
+// 5 seconds is used.
+func NewLogRenderer(out io.Writer, interval time.Duration) *LogRenderer {
+	if interval <= 0 {
+		interval = defaultloginterval
+	}
+
+	return &LogRenderer{
+		out:       out,
+		interval:  interval,
+		transfers: map[string]*loggedtransfer{},
+	}
+}
+
+// Progress implements ProgressRenderer.
+func (lr *LogRenderer) Progress(name string) ProgressFunc {
+	return ProgressEvents(lr.Handler(name), 0)
+}
+
+// Handler implements ProgressRenderer.
+func (lr *LogRenderer) Handler(name string) ProgressHandler {
+	return func(event ProgressEvent) {
+		lr.mu.Lock()
+		defer lr.mu.Unlock()
+
+		transfer, ok := lr.transfers[name]
+		if !ok {
+			transfer = &loggedtransfer{}
+			lr.transfers[name] = transfer
+		}
+
+		now := time.Now()
+		// The end of the transfer is logged once, even if it comes
+		// sooner than the interval.
+		finishing := event.Total > 0 && event.Current >= event.Total && !transfer.finished
+		if event.Phase == transfer.phase && !finishing && now.Sub(transfer.last) < lr.interval {
+			return
+		}
+
+		transfer.phase = event.Phase
+		transfer.last = now
+		if finishing {
+			transfer.finished = true
+		}
+		fmt.Fprintln(lr.out, progressline(name, event))
+	}
+}
+
+// Finish implements ProgressRenderer.
+func (lr *LogRenderer) Finish() {}
+
+// JSONRenderer renders each progress event as a line of JSON, for
+// consumption by other programs.
+type JSONRenderer struct {
+	mu  sync.Mutex
+	out io.Writer
+}
+
+// NewJSONRenderer returns a JSONRenderer that writes to out.
+func NewJSONRenderer(out io.Writer) *JSONRenderer {
+	return &JSONRenderer{out: out}
+}
+
+// jsonprogressevent is the JSON form of a progress event.
+type jsonprogressevent struct {
+	Name           string        `json:"name"`
+	Phase          ProgressPhase `json:"phase"`
+	Current        int64         `json:"current"`
+	Total          int64         `json:"total,omitempty"`
+	Rate           float64       `json:"rate"`
+	AverageRate    float64       `json:"averagerate"`
+	ETASeconds     float64       `json:"etaseconds,omitempty"`
+	ElapsedSeconds float64       `json:"elapsedseconds"`
+}
+
+// Progress implements ProgressRenderer.
+func (jr *JSONRenderer) Progress(name string) ProgressFunc {
+	return ProgressEvents(jr.Handler(name), 0)
+}
+
+// Handler implements ProgressRenderer.
+func (jr *JSONRenderer) Handler(name string) ProgressHandler {
+	return func(event ProgressEvent) {
+		data, err := json.Marshal(jsonprogressevent{
+			Name:           name,
+			Phase:          event.Phase,
+			Current:        event.Current,
+			Total:          event.Total,
+			Rate:           event.Rate,
+			AverageRate:    event.AverageRate,
+			ETASeconds:     event.ETA.Seconds(),
+			ElapsedSeconds: event.Elapsed.Seconds(),
+		})
+		if err != nil {
+			return
+		}
+
+		jr.mu.Lock()
+		defer jr.mu.Unlock()
+
+		jr.out.Write(append(data, '\n'))
+	}
+}
+
+// Finish implements ProgressRenderer.
+func (jr *JSONRenderer) Finish() {}
+
+// progressline formats a progress event as a single line of text.
+func progressline(name string, event ProgressEvent) string {
+	var sb strings.Builder
+	sb.WriteString(name)
+
+	if event.Total > 0 {
+		fraction := float64(event.Current) / float64(event.Total)
+		if fraction > 1 {
+			fraction = 1
+		}
+		filled := int(fraction * progressbarwidth)
+		fmt.Fprintf(
+			&sb,
+			" [%s%s] %3.0f%% %s/%s",
+			strings.Repeat("=", filled),
+			strings.Repeat(" ", progressbarwidth-filled),
+			fraction*100,
+			formatbytes(event.Current),
+			formatbytes(event.Total),
+		)
+	} else {
+		fmt.Fprintf(&sb, " %s", formatbytes(event.Current))
+	}
+
+	switch event.Phase {
+	case PhaseTransferring:
+		rate := event.Rate
+		if rate <= 0 {
+			rate = event.AverageRate
+		}
+		fmt.Fprintf(&sb, " %s/s", formatbytes(int64(rate)))
+		if event.ETA > 0 {
+			fmt.Fprintf(&sb, " ETA %s", event.ETA.Round(time.Second))
+		}
+	default:
+		fmt.Fprintf(&sb, " %s", event.Phase)
+	}
+
+	return sb.String()
+}
+
+// formatbytes formats a number of bytes using binary units.
+func formatbytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+
+	value := float64(n)
+	suffix := ""
+	for _, s := range []string{"KiB", "MiB", "GiB", "TiB"} {
+		value /= unit
+		suffix = s
+		if value < unit {
+			break
+		}
+	}
+
+	return fmt.Sprintf("%.1f %s", value, suffix)
+}
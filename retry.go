@@ -0,0 +1,178 @@
+package workspace
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// HTTPStatusError is returned when an HTTP server responds with an
+// unexpected status.
+type HTTPStatusError struct {
+	// StatusCode is the numeric HTTP status code.
+	StatusCode int
+	// Status is the HTTP status text.
+	Status string
+	// RetryAfter is the delay requested by the server via a Retry-After
+	// header, or 0.
+	RetryAfter time.Duration
+}
+
+func (hse *HTTPStatusError) Error() string {
+	return fmt.Sprintf("HTTP client returned the status: %v:%v", hse.StatusCode, hse.Status)
+}
+
+func newhttpstatuserror(resp *http.Response) *HTTPStatusError {
+	return &HTTPStatusError{
+		StatusCode: resp.StatusCode,
+		Status:     resp.Status,
+		RetryAfter: parseretryafter(resp.Header.Get("Retry-After")),
+	}
+}
+
+// parseretryafter parses a Retry-After header value, which can be either
+// a number of seconds or an HTTP date.
+func parseretryafter(value string) time.Duration {
+	if value == "" {
+		return 0
+	}
+
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+
+	if date, err := http.ParseTime(value); err == nil {
+		if delay := time.Until(date); delay > 0 {
+			return delay
+		}
+	}
+
+	return 0
+}
+
+// RetryPolicy specifies how failed downloads are retried.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first.
+	// A value of 1 or less means no retries.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry.
+	InitialBackoff time.Duration
+	// MaxBackoff caps the delay between retries, except when a server
+	// asks for a longer delay via a Retry-After header.
+	MaxBackoff time.Duration
+	// Multiplier is the factor by which the delay grows after each retry.
+	// If less than 1, 2 is used.
+	Multiplier float64
+	// Jitter randomly varies each delay by up to this fraction of it, in
+	// either direction. It should be between 0 and 1.
+	Jitter float64
+	// RetryableStatusCodes are HTTP status codes which cause a retry.
+	// Network errors always cause a retry.
+	RetryableStatusCodes []int
+}
+
+// DefaultRetryPolicy is a reasonable retry policy for downloads.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    4,
+	InitialBackoff: time.Second,
+	MaxBackoff:     30 * time.Second,
+	Multiplier:     2,
+	Jitter:         0.2,
+	RetryableStatusCodes: []int{
+		http.StatusRequestTimeout,
+		http.StatusTooEarly,
+		http.StatusTooManyRequests,
+		http.StatusInternalServerError,
+		http.StatusBadGateway,
+		http.StatusServiceUnavailable,
+		http.StatusGatewayTimeout,
+	},
+}
+
+var (
+	retrypolicylock sync.RWMutex
+	retrypolicy     *RetryPolicy
+)
+
+// SetRetryPolicy sets the retry policy used by downloads which do not
+// specify one. A nil policy, which is the initial setting, means that
+// downloads are not retried.
+func SetRetryPolicy(policy *RetryPolicy) {
+	retrypolicylock.Lock()
+	defer retrypolicylock.Unlock()
+
+	retrypolicy = policy
+}
+
+// GlobalRetryPolicy returns the retry policy set by SetRetryPolicy.
+func GlobalRetryPolicy() *RetryPolicy {
+	retrypolicylock.RLock()
+	defer retrypolicylock.RUnlock()
+
+	return retrypolicy
+}
+
+func (rp *RetryPolicy) attempts() int {
+	if rp == nil || rp.MaxAttempts < 1 {
+		return 1
+	}
+
+	return rp.MaxAttempts
+}
+
+// retryable returns true if an error is worth retrying.
+func (rp *RetryPolicy) retryable(err error) bool {
+	var statuserr *HTTPStatusError
+	if errors.As(err, &statuserr) {
+		for _, code := range rp.RetryableStatusCodes {
+			if code == statuserr.StatusCode {
+				return true
+			}
+		}
+		return false
+	}
+
+	// The HTTP client wraps all errors in a *url.Error, which would
+	// otherwise pass for a network error.
+	var urlerr *url.Error
+	if errors.As(err, &urlerr) {
+		err = urlerr.Err
+	}
+
+	var neterr net.Error
+	return errors.As(err, &neterr) ||
+		errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, io.EOF)
+}
+
+// backoff returns the delay before the specified retry, counting from 1.
+func (rp *RetryPolicy) backoff(retry int, err error) time.Duration {
+	multiplier := rp.Multiplier
+	if multiplier < 1 {
+		multiplier = 2
+	}
+
+	delay := float64(rp.InitialBackoff) * math.Pow(multiplier, float64(retry-1))
+	if rp.MaxBackoff > 0 && delay > float64(rp.MaxBackoff) {
+		delay = float64(rp.MaxBackoff)
+	}
+	if rp.Jitter > 0 {
+		delay += delay * rp.Jitter * (2*rand.Float64() - 1)
+	}
+
+	result := time.Duration(delay)
+	var statuserr *HTTPStatusError
+	if errors.As(err, &statuserr) && statuserr.RetryAfter > result {
+		result = statuserr.RetryAfter
+	}
+
+	return result
+}
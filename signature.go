@@ -0,0 +1,319 @@
+package workspace
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/blake2b"
+)
+
+// Signatures are verified in the minisign format, which uses Ed25519 keys.
+// Both legacy signatures over the whole file, and prehashed signatures over
+// a BLAKE2b-512 hash of the file, are supported.
+
+const trustedkeysfilename = "trustedkeys.json"
+
+// MaxLegacySignedSize is the largest file that can be verified against a
+// legacy minisign signature, which has to hold the whole file in memory.
+// Larger files must be signed with prehashed signatures, which minisign
+// makes by default.
+const MaxLegacySignedSize = 64 << 20
+
+var (
+	// ErrUntrustedKey is returned when a signature was made with a key
+	// that is not in the workspace's trusted keys.
+	ErrUntrustedKey = errors.New("signature key is not trusted")
+	// ErrInvalidSignature is returned when a signature does not match the
+	// signed data.
+	ErrInvalidSignature = errors.New("invalid signature")
+	// ErrLegacySignatureTooLarge is returned, wrapped, when a file larger
+	// than MaxLegacySignedSize has a legacy signature.
+	ErrLegacySignatureTooLarge = errors.New("file too large for a legacy signature")
+)
+
+// TrustedKey is a public key trusted to sign downloaded files.
+type TrustedKey struct {
+	// Name identifies the key in the trusted key list.
+	Name string `json:"name"`
+	// KeyID is the minisign key ID, as a hexadecimal string.
+	KeyID string `json:"keyid"`
+	// PublicKey is the base64-encoded minisign public key.
+	PublicKey string `json:"publickey"`
+}
+
+type trustedkeys struct {
+	Keys []TrustedKey `json:"keys"`
+}
+
+func (tk *trustedkeys) Serialize() ([]byte, error) {
+	return json.MarshalIndent(tk, "", "  ")
+}
+
+func (tk *trustedkeys) Deserialize(data []byte) error {
+	var loaded trustedkeys
+	err := json.Unmarshal(data, &loaded)
+	if err == nil {
+		tk.Keys = loaded.Keys
+	}
+	return err
+}
+
+func (tk *trustedkeys) SetDefaults() {
+	tk.Keys = []TrustedKey{}
+}
+
+func loadtrustedkeys() (*trustedkeys, ConfigManager, error) {
+	keys := &trustedkeys{}
+	cm, err := NewFileConfigManager(trustedkeysfilename, keys)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return keys, cm, nil
+}
+
+// AddTrustedKey adds a minisign public key to the workspace's trusted keys,
+// under the specified name. The public key can be the contents of a minisign
+// public key file, or just the base64-encoded key line. An existing key with
+// the same name is replaced.
+func AddTrustedKey(name string, publickey string) error {
+	if name == "" {
+		return errors.New("trusted key name must not be empty")
+	}
+
+	keyline := lastnoncommentline(publickey)
+	keyid, _, err := parseminisignpublickey(keyline)
+	if err != nil {
+		return err
+	}
+
+	keys, cm, err := loadtrustedkeys()
+	if err != nil {
+		return err
+	}
+
+	newkey := TrustedKey{
+		Name:      name,
+		KeyID:     formatkeyid(keyid),
+		PublicKey: keyline,
+	}
+	replaced := false
+	for i := range keys.Keys {
+		if keys.Keys[i].Name == name {
+			keys.Keys[i] = newkey
+			replaced = true
+		}
+	}
+	if !replaced {
+		keys.Keys = append(keys.Keys, newkey)
+	}
+
+	return cm.Save()
+}
+
+// ListTrustedKeys returns the workspace's trusted keys, sorted by name.
+func ListTrustedKeys() ([]TrustedKey, error) {
+	keys, _, err := loadtrustedkeys()
+	if err != nil {
+		return nil, err
+	}
+
+	result := append([]TrustedKey(nil), keys.Keys...)
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Name < result[j].Name
+	})
+	return result, nil
+}
+
+// RemoveTrustedKey removes the named key from the workspace's trusted keys.
+func RemoveTrustedKey(name string) error {
+	keys, cm, err := loadtrustedkeys()
+	if err != nil {
+		return err
+	}
+
+	remaining := keys.Keys[:0]
+	for _, key := range keys.Keys {
+		if key.Name != name {
+			remaining = append(remaining, key)
+		}
+	}
+	if len(remaining) == len(keys.Keys) {
+		return fmt.Errorf("no trusted key named %s", name)
+	}
+
+	keys.Keys = remaining
+	return cm.Save()
+}
+
+// VerifySignature checks that a file was signed by one of the workspace's
+// trusted keys. The signature parameter is the contents of a minisign
+// signature file. If the key is not trusted, ErrUntrustedKey is returned.
+// If the signature does not match, ErrInvalidSignature is returned.
+func VerifySignature(filepath string, signature []byte) error {
+	f, err := os.Open(filepath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return verifysignature(f, signature)
+}
+
+// VerifySignatureFile checks that a file was signed by one of the
+// workspace's trusted keys, using a minisign signature file.
+func VerifySignatureFile(filepath string, signaturepath string) error {
+	signature, err := os.ReadFile(signaturepath)
+	if err != nil {
+		return err
+	}
+
+	return VerifySignature(filepath, signature)
+}
+
+func verifysignature(data io.Reader, signature []byte) error {
+	lines := signaturelines(string(signature))
+	if len(lines) != 4 ||
+		!strings.HasPrefix(lines[0], "untrusted comment:") ||
+		!strings.HasPrefix(lines[2], "trusted comment: ") {
+		return errors.New("malformed minisign signature")
+	}
+
+	sigbytes, err := base64.StdEncoding.DecodeString(lines[1])
+	if err != nil || len(sigbytes) != 2+8+ed25519.SignatureSize {
+		return errors.New("malformed minisign signature")
+	}
+	algorithm := string(sigbytes[:2])
+	keyid := sigbytes[2:10]
+	sig := sigbytes[10:]
+
+	globalsig, err := base64.StdEncoding.DecodeString(lines[3])
+	if err != nil || len(globalsig) != ed25519.SignatureSize {
+		return errors.New("malformed minisign trusted comment signature")
+	}
+
+	publickey, err := findtrustedkey(keyid)
+	if err != nil {
+		return err
+	}
+
+	var message []byte
+	switch algorithm {
+	case "Ed":
+		message, err = io.ReadAll(io.LimitReader(data, MaxLegacySignedSize+1))
+		if err == nil && len(message) > MaxLegacySignedSize {
+			return fmt.Errorf(
+				"%w: files over %v bytes must have prehashed signatures",
+				ErrLegacySignatureTooLarge,
+				MaxLegacySignedSize,
+			)
+		}
+	case "ED":
+		h, _ := blake2b.New512(nil)
+		_, err = io.Copy(h, data)
+		message = h.Sum(nil)
+	default:
+		return fmt.Errorf("unsupported minisign signature algorithm '%s'", algorithm)
+	}
+	if err != nil {
+		return err
+	}
+
+	if !ed25519.Verify(publickey, message, sig) {
+		return ErrInvalidSignature
+	}
+
+	trustedcomment := strings.TrimPrefix(lines[2], "trusted comment: ")
+	if !ed25519.Verify(publickey, append(sig, trustedcomment...), globalsig) {
+		return fmt.Errorf("%w: trusted comment has been tampered with", ErrInvalidSignature)
+	}
+
+	return nil
+}
+
+func findtrustedkey(keyid []byte) (ed25519.PublicKey, error) {
+	keys, err := ListTrustedKeys()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range keys {
+		id, publickey, err := parseminisignpublickey(key.PublicKey)
+		if err == nil && bytes.Equal(id, keyid) {
+			return publickey, nil
+		}
+	}
+
+	return nil, fmt.Errorf("%w: key ID %s", ErrUntrustedKey, formatkeyid(keyid))
+}
+
+// parseminisignpublickey parses a base64-encoded minisign public key,
+// returning its key ID and Ed25519 public key.
+func parseminisignpublickey(keyline string) ([]byte, ed25519.PublicKey, error) {
+	keybytes, err := base64.StdEncoding.DecodeString(keyline)
+	if err != nil ||
+		len(keybytes) != 2+8+ed25519.PublicKeySize ||
+		string(keybytes[:2]) != "Ed" {
+		return nil, nil, errors.New("malformed minisign public key")
+	}
+
+	return keybytes[2:10], ed25519.PublicKey(keybytes[10:]), nil
+}
+
+// formatkeyid formats a key ID the way minisign displays it.
+func formatkeyid(keyid []byte) string {
+	return fmt.Sprintf("%016X", binary.LittleEndian.Uint64(keyid))
+}
+
+func signaturelines(text string) []string {
+	var result []string
+	for _, line := range strings.Split(text, "\n") {
+		line = strings.TrimRight(line, "\r")
+		if line != "" {
+			result = append(result, line)
+		}
+	}
+	return result
+}
+
+func lastnoncommentline(text string) string {
+	result := ""
+	for _, line := range signaturelines(text) {
+		if !strings.HasPrefix(line, "untrusted comment:") {
+			result = strings.TrimSpace(line)
+		}
+	}
+	return result
+}
+
+// fetchsignature reads a signature from a local file, or downloads it if
+// source is a URL.
+func (d *Downloader) fetchsignature(ctx context.Context, source string) ([]byte, error) {
+	if !strings.Contains(source, "://") {
+		return os.ReadFile(source)
+	}
+
+	tmpfile, err := os.CreateTemp("", "kutti-signature-*")
+	if err != nil {
+		return nil, err
+	}
+	tmpfile.Close()
+	defer os.Remove(tmpfile.Name())
+
+	err = d.DownloadFileContext(ctx, source, tmpfile.Name(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	return os.ReadFile(tmpfile.Name())
+}
@@ -0,0 +1,101 @@
+package workspace
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/kuttiproject/kuttilog"
+)
+
+// InsufficientSpaceError is returned when a copy or download is not
+// started, because the destination filesystem does not have enough free
+// space for it.
+type InsufficientSpaceError struct {
+	// Path is the destination of the copy or download.
+	Path string
+	// Required is the number of bytes needed, including the margin set by
+	// SetFreeSpaceMargin.
+	Required int64
+	// Available is the number of bytes free.
+	Available int64
+}
+
+func (ise *InsufficientSpaceError) Error() string {
+	return fmt.Sprintf(
+		"not enough free space for %s: %v bytes required, %v bytes available",
+		ise.Path,
+		ise.Required,
+		ise.Available,
+	)
+}
+
+var (
+	freespacelock   sync.RWMutex
+	freespacemargin int64
+)
+
+// SetFreeSpaceMargin sets the number of bytes that must remain free on the
+// destination filesystem after a copy or download. The initial setting is
+// 0.
+func SetFreeSpaceMargin(margin int64) {
+	freespacelock.Lock()
+	defer freespacelock.Unlock()
+
+	if margin < 0 {
+		margin = 0
+	}
+	freespacemargin = margin
+}
+
+// FreeSpaceMargin returns the margin set by SetFreeSpaceMargin.
+func FreeSpaceMargin() int64 {
+	freespacelock.RLock()
+	defer freespacelock.RUnlock()
+
+	return freespacemargin
+}
+
+// FreeSpace returns the number of bytes available to the current user on
+// the filesystem containing path, which must exist.
+func FreeSpace(path string) (int64, error) {
+	return freespace(path)
+}
+
+// checkfreespace returns an *InsufficientSpaceError if the filesystem that
+// destpath will be written to has less than size bytes free, plus the
+// margin. If the size is not known, or free space cannot be determined on
+// this platform, the check passes.
+func checkfreespace(destpath string, size int64) error {
+	if size <= 0 {
+		return nil
+	}
+
+	available, err := freespace(filepath.Dir(destpath))
+	if err != nil {
+		kuttilog.Printf(kuttilog.Debug, "Could not check free space for %s: %v", destpath, err)
+		return nil
+	}
+
+	required := size + FreeSpaceMargin()
+	if available < required {
+		return &InsufficientSpaceError{Path: destpath, Required: required, Available: available}
+	}
+
+	return nil
+}
+
+// reservespace asks the filesystem to allocate size bytes for a file about
+// to be written, where the platform supports it, so that the file is less
+// fragmented and running out of space is detected early. The file's size
+// is not changed. Failure is not an error.
+func reservespace(f *os.File, size int64) {
+	if size <= 0 {
+		return
+	}
+
+	if err := preallocate(f, size); err != nil {
+		kuttilog.Printf(kuttilog.Debug, "Could not preallocate %s: %v", f.Name(), err)
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd && !windows
+
+package workspace
+
+import (
+	"errors"
+	"runtime"
+)
+
+func freespace(path string) (int64, error) {
+	return 0, errors.New("free space cannot be determined on " + runtime.GOOS)
+}
@@ -0,0 +1,19 @@
+//go:build linux || darwin || freebsd
+
+package workspace
+
+import "syscall"
+
+func freespace(path string) (int64, error) {
+	var stat syscall.Statfs_t
+	if err := syscall.Statfs(path, &stat); err != nil {
+		return 0, err
+	}
+
+	available := int64(stat.Bavail) * int64(stat.Bsize)
+	if available < 0 {
+		available = 0
+	}
+
+	return available, nil
+}
@@ -0,0 +1,30 @@
+//go:build windows
+
+package workspace
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+var getdiskfreespaceex = syscall.NewLazyDLL("kernel32.dll").NewProc("GetDiskFreeSpaceExW")
+
+func freespace(path string) (int64, error) {
+	pathptr, err := syscall.UTF16PtrFromString(path)
+	if err != nil {
+		return 0, err
+	}
+
+	var available uint64
+	result, _, err := getdiskfreespaceex.Call(
+		uintptr(unsafe.Pointer(pathptr)),
+		uintptr(unsafe.Pointer(&available)),
+		0,
+		0,
+	)
+	if result == 0 {
+		return 0, err
+	}
+
+	return int64(available), nil
+}
@@ -1,13 +1,32 @@
 package workspace_test
 
 import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/klauspost/compress/zstd"
 	"github.com/kuttiproject/workspace"
+	"github.com/ulikunitz/xz"
 )
 
 const tsubdirname = "testsubdir"
@@ -533,3 +552,2501 @@ func TestRunWithResults(t *testing.T) {
 	}
 	t.Logf("Output was: \n'%v'\n", output)
 }
+
+// Cache index tests
+func writecachefile(t *testing.T, subdir string, filename string, content string) string {
+	dir, err := workspace.CacheSubDir(subdir)
+	if err != nil {
+		t.Logf("CacheSubDir failed with error: %v", err)
+		t.FailNow()
+	}
+
+	path := filepath.Join(dir, filename)
+	err = os.WriteFile(path, []byte(content), 0644)
+	if err != nil {
+		t.Logf("Could not create cache file %v: %v", path, err)
+		t.FailNow()
+	}
+
+	return path
+}
+
+func TestCacheGC(t *testing.T) {
+	tdir := t.TempDir()
+	workspace.Set(tdir)
+	defer workspace.Reset()
+
+	pinnedpath := writecachefile(t, "images", "pinned.img", "pinned image")
+	writecachefile(t, "images", "unpinned.img", "unpinned image")
+	writecachefile(t, "images", "orphan.img", "orphan")
+	// Files of a download in progress are not orphans
+	partialpaths := []string{
+		writecachefile(t, "images", "partial.img.download", "partial"),
+		writecachefile(t, "images", "partial.img.download.json", "{}"),
+		writecachefile(t, "images", "partial.img.lock", "lock"),
+	}
+
+	_, err := workspace.AddCacheEntry("pinned", pinnedpath, "image")
+	if err != nil {
+		t.Logf("AddCacheEntry failed with error: %v", err)
+		t.FailNow()
+	}
+
+	_, err = workspace.AddCacheEntry("unpinned", "images/unpinned.img", "image")
+	if err != nil {
+		t.Logf("AddCacheEntry with relative path failed with error: %v", err)
+		t.FailNow()
+	}
+
+	_, err = workspace.AddCacheEntry("outside", filepath.Join(tdir, "outside.img"))
+	if err == nil {
+		t.Log("AddCacheEntry should not have accepted a path outside the cache directory.")
+		t.Fail()
+	}
+
+	err = workspace.Pin("pinned", "cluster1")
+	if err != nil {
+		t.Logf("Pin failed with error: %v", err)
+		t.FailNow()
+	}
+
+	err = workspace.Pin("notthere", "cluster1")
+	if err != workspace.ErrCacheEntryNotFound {
+		t.Logf("Pinning a non-existent entry returned: %v", err)
+		t.Fail()
+	}
+
+	err = workspace.RemoveCacheEntry("pinned")
+	if err == nil {
+		t.Log("RemoveCacheEntry should not have removed a pinned entry.")
+		t.Fail()
+	}
+
+	result, err := workspace.GC(workspace.GCOptions{DryRun: true, RemoveOrphans: true})
+	if err != nil {
+		t.Logf("GC dry run failed with error: %v", err)
+		t.FailNow()
+	}
+
+	if len(result.Entries) != 1 || result.Entries[0] != "unpinned" ||
+		len(result.Orphans) != 1 || result.Orphans[0] != "images/orphan.img" ||
+		result.Freed != int64(len("unpinned image")+len("orphan")) {
+		t.Logf("GC dry run reported: %#v", result)
+		t.Fail()
+	}
+
+	entries, _ := workspace.ListCacheEntries()
+	if len(entries) != 2 {
+		t.Logf("GC dry run removed entries. Remaining: %v", len(entries))
+		t.Fail()
+	}
+
+	result, err = workspace.GC(workspace.GCOptions{RemoveOrphans: true})
+	if err != nil {
+		t.Logf("GC failed with error: %v", err)
+		t.FailNow()
+	}
+	t.Logf("GC result: %#v", result)
+
+	for _, partialpath := range partialpaths {
+		if _, err := os.Stat(partialpath); err != nil {
+			t.Logf("In-progress file should have survived GC: %v", err)
+			t.Fail()
+		}
+	}
+
+	_, err = workspace.GetCacheEntry("unpinned")
+	if err != workspace.ErrCacheEntryNotFound {
+		t.Logf("Unpinned entry should have been removed. Got error: %v", err)
+		t.Fail()
+	}
+
+	entry, err := workspace.GetCacheEntry("pinned")
+	if err != nil {
+		t.Logf("Pinned entry should have survived GC. Got error: %v", err)
+		t.FailNow()
+	}
+
+	if err = checkfile(entry); err != nil {
+		t.Logf("Pinned entry file should have survived GC: %v", err)
+		t.Fail()
+	}
+
+	err = workspace.Unpin("pinned", "cluster1")
+	if err != nil {
+		t.Logf("Unpin failed with error: %v", err)
+		t.FailNow()
+	}
+
+	err = workspace.RemoveCacheEntry("pinned")
+	if err != nil {
+		t.Logf("RemoveCacheEntry failed after unpinning: %v", err)
+		t.Fail()
+	}
+
+	// Simulate another process updating the index while holding its lock
+	sharedpath := writecachefile(t, "images", "shared.img", "shared image")
+	workspace.AddCacheEntry("shared", sharedpath)
+	indexpath := filepath.Join(filepath.Dir(filepath.Dir(sharedpath)), "cacheindex.json")
+	lockpath := indexpath + ".lock"
+	os.WriteFile(lockpath, []byte("0\n"), 0644)
+	var index map[string]any
+	data, _ := os.ReadFile(indexpath)
+	json.Unmarshal(data, &index)
+	otherdone := make(chan struct{})
+	go func() {
+		defer close(otherdone)
+		time.Sleep(200 * time.Millisecond)
+		index["entries"].(map[string]any)["other"] = map[string]any{"key": "other", "path": "images/other.img"}
+		data, _ = json.Marshal(index)
+		os.WriteFile(indexpath, data, 0644)
+		os.Remove(lockpath)
+	}()
+
+	err = workspace.Pin("shared", "cluster2")
+	<-otherdone
+	if err != nil {
+		t.Logf("Pin failed with error: %v", err)
+		t.FailNow()
+	}
+	if _, err := workspace.GetCacheEntry("other"); err != nil {
+		t.Logf("Entry added by another process was lost: %v", err)
+		t.Fail()
+	}
+	if entry, err := workspace.GetCacheEntry("shared"); err != nil || !entry.Pinned() {
+		t.Logf("Pin was lost to another process's update: %v, %v", entry, err)
+		t.Fail()
+	}
+}
+
+func checkfile(entry *workspace.CacheEntry) error {
+	path, err := entry.FullPath()
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stat(path)
+	return err
+}
+
+func TestFetchCacheEntry(t *testing.T) {
+	tdir := t.TempDir()
+	workspace.Set(tdir)
+	defer workspace.Reset()
+
+	const etag = `"v1"`
+	fullfetches := 0
+	revalidations := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("If-None-Match") == etag {
+			revalidations++
+			w.Header().Set("Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		fullfetches++
+		w.Header().Set("ETag", etag)
+		w.Write([]byte(`["v1.0","v1.1"]`))
+	}))
+	defer server.Close()
+
+	entry, err := workspace.FetchCacheEntry("versions", server.URL, "versions.json", time.Hour, "metadata")
+	if err != nil {
+		t.Logf("FetchCacheEntry failed with error: %v", err)
+		t.FailNow()
+	}
+
+	if entry.ETag != etag || entry.SourceURL != server.URL || entry.Expired() {
+		t.Logf("FetchCacheEntry returned unexpected entry: %#v", entry)
+		t.Fail()
+	}
+
+	// Fresh entry should not cause a request
+	_, err = workspace.FetchCacheEntry("versions", server.URL, "versions.json", time.Hour, "metadata")
+	if err != nil || fullfetches != 1 || revalidations != 0 {
+		t.Logf("Fresh fetch: error %v, %v fetches, %v revalidations", err, fullfetches, revalidations)
+		t.Fail()
+	}
+
+	// Stale entry should cause a conditional request
+	err = workspace.SetCacheEntryTTL("versions", time.Nanosecond)
+	if err != nil {
+		t.Logf("SetCacheEntryTTL failed with error: %v", err)
+		t.FailNow()
+	}
+	time.Sleep(time.Millisecond)
+
+	entry, err = workspace.FetchCacheEntry("versions", server.URL, "versions.json", time.Hour, "metadata")
+	if err != nil || fullfetches != 1 || revalidations != 1 {
+		t.Logf("Stale fetch: error %v, %v fetches, %v revalidations", err, fullfetches, revalidations)
+		t.FailNow()
+	}
+
+	if entry.Expired() || entry.ETag != etag || entry.LastModified != "Mon, 02 Jan 2006 15:04:05 GMT" {
+		t.Logf("Revalidated entry should be fresh, with updated validators: %#v", entry)
+		t.Fail()
+	}
+
+	// Concurrent fetches of the same entry do not clash
+	results := make(chan error, 4)
+	for i := 0; i < 4; i++ {
+		go func() {
+			_, err := workspace.FetchCacheEntry("concurrent", server.URL, "concurrent.json", time.Hour)
+			results <- err
+		}()
+	}
+	for i := 0; i < 4; i++ {
+		if err := <-results; err != nil {
+			t.Logf("Concurrent FetchCacheEntry failed with error: %v", err)
+			t.Fail()
+		}
+	}
+	entry, err = workspace.GetCacheEntry("concurrent")
+	if err != nil || checkfile(entry) != nil {
+		t.Logf("Concurrently fetched entry is not valid, error: %v", err)
+		t.Fail()
+	}
+
+	// A fetch that waits for another process still records validators
+	cachedir, _ := workspace.CacheDir()
+	otherpath := filepath.Join(cachedir, "other.json")
+	lockpath := otherpath + ".lock"
+	os.WriteFile(lockpath, []byte("0\n"), 0644)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		os.WriteFile(otherpath, []byte(`["v1.0","v1.1"]`), 0644)
+		os.Remove(lockpath)
+	}()
+	entry, err = workspace.FetchCacheEntry("other", server.URL, "other.json", time.Hour)
+	if err != nil || entry.ETag != etag {
+		t.Logf("Fetch after waiting for another process: error %v, entry %#v", err, entry)
+		t.Fail()
+	}
+}
+
+func TestVerifyCache(t *testing.T) {
+	tdir := t.TempDir()
+	workspace.Set(tdir)
+	defer workspace.Reset()
+
+	goodpath := writecachefile(t, "images", "good.img", "good image")
+	badpath := writecachefile(t, "images", "bad.img", "bad image")
+	missingpath := writecachefile(t, "images", "missing.img", "missing image")
+
+	for key, path := range map[string]string{
+		"good":    goodpath,
+		"bad":     badpath,
+		"missing": missingpath,
+	} {
+		_, err := workspace.AddCacheEntry(key, path)
+		if err != nil {
+			t.Logf("AddCacheEntry failed with error: %v", err)
+			t.FailNow()
+		}
+	}
+
+	os.WriteFile(badpath, []byte("bit-rotted image"), 0644)
+	os.Remove(missingpath)
+
+	var lastprogress, lasttotal int64
+	result, err := workspace.VerifyCache(workspace.VerifyCacheOptions{
+		Workers: 2,
+		Progress: func(progress int64, total int64) {
+			lastprogress, lasttotal = progress, total
+		},
+	})
+	if err != nil {
+		t.Logf("VerifyCache failed with error: %v", err)
+		t.FailNow()
+	}
+
+	if result.Checked != 3 || len(result.Issues) != 2 ||
+		result.Issues[0].Key != "bad" || result.Issues[0].Actual == "" ||
+		result.Issues[1].Key != "missing" || !result.Issues[1].Missing {
+		t.Logf("VerifyCache returned unexpected result: %#v", result)
+		t.Fail()
+	}
+
+	if lastprogress == 0 || lasttotal == 0 {
+		t.Logf("Progress reported %v of %v bytes.", lastprogress, lasttotal)
+		t.Fail()
+	}
+
+	result, err = workspace.VerifyCache(workspace.VerifyCacheOptions{
+		Repair: workspace.RepairRemove,
+	})
+	if err != nil {
+		t.Logf("VerifyCache with repair failed with error: %v", err)
+		t.FailNow()
+	}
+
+	for _, issue := range result.Issues {
+		if issue.Repair != "removed" {
+			t.Logf("Issue was not repaired: %#v", issue)
+			t.Fail()
+		}
+	}
+
+	entries, _ := workspace.ListCacheEntries()
+	if len(entries) != 1 || entries[0].Key != "good" {
+		t.Logf("Bad entries should have been removed. Entries: %v", len(entries))
+		t.Fail()
+	}
+
+	// An entry added again after verification is not removed
+	writecachefile(t, "images", "readded.img", "bad image")
+	workspace.AddCacheEntry("readded", "images/readded.img")
+	writecachefile(t, "images", "readded.img", "bit-rotted image")
+	readded := false
+	result, err = workspace.VerifyCache(workspace.VerifyCacheOptions{
+		Workers: 1,
+		Repair:  workspace.RepairRemove,
+		Progress: func(progress int64, total int64) {
+			if !readded {
+				readded = true
+				workspace.AddCacheEntry("readded", "images/readded.img")
+			}
+		},
+	})
+	if err != nil || len(result.Issues) != 1 || result.Issues[0].Repair != "" || result.Issues[0].Error == "" {
+		t.Logf("VerifyCache with a re-added entry returned: %#v, with error: %v", result, err)
+		t.Fail()
+	}
+	if _, err := workspace.GetCacheEntry("readded"); err != nil {
+		t.Logf("Re-added entry should not have been removed: %v", err)
+		t.Fail()
+	}
+}
+
+func TestCacheUsage(t *testing.T) {
+	tdir := t.TempDir()
+	workspace.Set(tdir)
+	defer workspace.Reset()
+
+	imagepath := writecachefile(t, "images", "node.img", "0123456789")
+	writecachefile(t, "images", "orphan.img", "01234")
+	writecachefile(t, "images", "partial.img.download", "0123456")
+	toolpath := writecachefile(t, "tools", "kubectl", "012")
+
+	workspace.AddCacheEntry("node", imagepath, "image")
+	workspace.AddCacheEntry("kubectl", toolpath, "tool")
+	workspace.Pin("node", "cluster1")
+
+	workspace.GetCacheEntry("node")
+	workspace.GetCacheEntry("notthere")
+
+	report, err := workspace.CacheUsage()
+	if err != nil {
+		t.Logf("CacheUsage failed with error: %v", err)
+		t.FailNow()
+	}
+
+	if report.Total.Files != 4 || report.Total.Entries != 2 || report.Total.Size != 25 {
+		t.Logf("Unexpected total: %#v", report.Total)
+		t.Fail()
+	}
+
+	if report.BySubdirectory["images"].Size != 22 || report.BySubdirectory["tools"].Files != 1 {
+		t.Logf("Unexpected subdirectory breakdown: %#v", report.BySubdirectory)
+		t.Fail()
+	}
+
+	if report.ByLabel["image"].Entries != 1 || report.ByLabel["tool"].Size != 3 {
+		t.Logf("Unexpected label breakdown: %#v", report.ByLabel)
+		t.Fail()
+	}
+
+	if report.Hits != 1 || report.Misses != 1 {
+		t.Logf("Expected 1 hit and 1 miss, got %v and %v", report.Hits, report.Misses)
+		t.Fail()
+	}
+
+	if report.Reclaimable != 3 || report.Orphaned != 5 {
+		t.Logf("Expected 3 reclaimable and 5 orphaned bytes, got %v and %v", report.Reclaimable, report.Orphaned)
+		t.Fail()
+	}
+
+	if report.Oldest == nil || report.Newest == nil {
+		t.Log("Oldest and newest entries not reported.")
+		t.Fail()
+	}
+
+	var buf bytes.Buffer
+	err = json.NewEncoder(&buf).Encode(report)
+	if err != nil {
+		t.Logf("Report could not be serialized: %v", err)
+		t.Fail()
+	}
+}
+
+// Offline and mirror tests
+func TestMirrors(t *testing.T) {
+	defer workspace.SetMirrors()
+	defer workspace.SetOffline(false)
+
+	const content = "mirrored content"
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	mirrordir := t.TempDir()
+	fileurl := server.URL + "/images/node.img"
+
+	err := workspace.PopulateMirror(mirrordir, fileurl)
+	if err != nil {
+		t.Logf("PopulateMirror failed with error: %v", err)
+		t.FailNow()
+	}
+
+	err = workspace.SetMirrors("file://" + filepath.ToSlash(mirrordir))
+	if err != nil {
+		t.Logf("SetMirrors failed with error: %v", err)
+		t.FailNow()
+	}
+	workspace.SetOffline(true)
+
+	destpath := filepath.Join(t.TempDir(), "node.img")
+	err = workspace.DownloadFile(fileurl, destpath)
+	if err != nil {
+		t.Logf("DownloadFile from mirror failed with error: %v", err)
+		t.FailNow()
+	}
+
+	data, _ := os.ReadFile(destpath)
+	if string(data) != content || requests != 1 {
+		t.Logf("Expected mirrored content after 1 request, got '%s' after %v", data, requests)
+		t.Fail()
+	}
+
+	err = workspace.DownloadFile(server.URL+"/images/notmirrored.img", destpath)
+	var offlineerr *workspace.OfflineError
+	if !errors.As(err, &offlineerr) {
+		t.Logf("Expected an OfflineError, got: %v", err)
+		t.Fail()
+	}
+}
+
+// Download tests
+func TestDownloadFileContext(t *testing.T) {
+	release := make(chan struct{})
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		w.Write(make([]byte, 100))
+		w.(http.Flusher).Flush()
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer server.Close()
+	defer close(release)
+
+	destpath := filepath.Join(t.TempDir(), "hung.img")
+	ctx, cancel := context.WithCancel(context.Background())
+	err := workspace.DownloadFileContext(ctx, server.URL, destpath, &workspace.DownloadOptions{
+		Progress: func(progress int64, total int64) {
+			cancel()
+		},
+	})
+
+	if !errors.Is(err, workspace.ErrDownloadCancelled) || !errors.Is(err, context.Canceled) {
+		t.Logf("Expected a cancellation error, got: %v", err)
+		t.Fail()
+	}
+
+	if _, err = os.Stat(destpath + ".download"); !os.IsNotExist(err) {
+		t.Log("Temporary file should have been removed.")
+		t.Fail()
+	}
+
+	ctx, cancel = context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = workspace.DownloadFileContext(ctx, server.URL, destpath, nil)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Logf("Expected a deadline error, got: %v", err)
+		t.Fail()
+	}
+}
+
+func TestDownloadResume(t *testing.T) {
+	data := bytes.Repeat([]byte("0123456789"), 10000)
+	const etag = `"resumable"`
+
+	requests := 0
+	rangerequested := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		w.Header().Set("ETag", etag)
+		if requests == 1 {
+			// Send half the file, then drop the connection
+			w.Header().Set("Content-Length", "100000")
+			w.Write(data[:50000])
+			w.(http.Flusher).Flush()
+			panic(http.ErrAbortHandler)
+		}
+
+		rangerequested = r.Header.Get("Range")
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	destpath := filepath.Join(t.TempDir(), "resumable.img")
+	options := &workspace.DownloadOptions{Resume: true}
+	err := workspace.DownloadFileContext(context.Background(), server.URL, destpath, options)
+	if err == nil {
+		t.Log("First download attempt should have failed.")
+		t.FailNow()
+	}
+
+	firstprogress := int64(-1)
+	options.Progress = func(progress int64, total int64) {
+		if firstprogress == -1 {
+			firstprogress = progress
+		}
+	}
+	err = workspace.DownloadFileContext(context.Background(), server.URL, destpath, options)
+	if err != nil {
+		t.Logf("Resumed download failed with error: %v", err)
+		t.FailNow()
+	}
+
+	if rangerequested != "bytes=50000-" {
+		t.Logf("Expected range request from byte 50000, got '%v'", rangerequested)
+		t.Fail()
+	}
+
+	if firstprogress <= 50000 {
+		t.Logf("Progress should have started after the resumed offset. Got %v", firstprogress)
+		t.Fail()
+	}
+
+	downloaded, _ := os.ReadFile(destpath)
+	if !bytes.Equal(downloaded, data) {
+		t.Log("Resumed download does not match source.")
+		t.Fail()
+	}
+}
+
+func TestDownloadRetry(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.URL.Path == "/notthere" {
+			http.NotFound(w, r)
+			return
+		}
+		if requests < 3 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.Write([]byte("finally"))
+	}))
+	defer server.Close()
+
+	policy := workspace.DefaultRetryPolicy
+	policy.InitialBackoff = time.Millisecond
+	options := &workspace.DownloadOptions{Retry: &policy}
+
+	destpath := filepath.Join(t.TempDir(), "retried.txt")
+	err := workspace.DownloadFileContext(context.Background(), server.URL, destpath, options)
+	if err != nil || requests != 3 {
+		t.Logf("Download failed after %v requests with error: %v", requests, err)
+		t.Fail()
+	}
+
+	requests = 0
+	err = workspace.DownloadFileContext(context.Background(), server.URL+"/notthere", destpath, options)
+	var statuserr *workspace.HTTPStatusError
+	if !errors.As(err, &statuserr) || statuserr.StatusCode != http.StatusNotFound || requests != 1 {
+		t.Logf("Expected a single 404 attempt, got %v requests with error: %v", requests, err)
+		t.Fail()
+	}
+
+	// With the global policy
+	workspace.SetRetryPolicy(&policy)
+	defer workspace.SetRetryPolicy(nil)
+
+	requests = 0
+	err = workspace.DownloadFile(server.URL, destpath)
+	if err != nil || requests != 3 {
+		t.Logf("Download with global policy failed after %v requests with error: %v", requests, err)
+		t.Fail()
+	}
+}
+
+func TestDownloadChecksum(t *testing.T) {
+	const content = "checksummed content"
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	tdir := t.TempDir()
+	sourcepath := filepath.Join(tdir, "source.txt")
+	os.WriteFile(sourcepath, []byte(content), 0644)
+	checksum, _ := workspace.ChecksumFile(sourcepath)
+
+	digest, err := workspace.ParseDigest("sha256:" + checksum)
+	if err != nil {
+		t.Logf("ParseDigest failed with error: %v", err)
+		t.FailNow()
+	}
+
+	destpath := filepath.Join(tdir, "dest.txt")
+	err = workspace.DownloadFileContext(context.Background(), server.URL, destpath, &workspace.DownloadOptions{
+		Checksum: digest,
+	})
+	if err != nil {
+		t.Logf("Download with correct checksum failed with error: %v", err)
+		t.Fail()
+	}
+
+	os.Remove(destpath)
+	baddigest, _ := workspace.ParseDigest(
+		"sha512:" + string(bytes.Repeat([]byte("ab"), 64)),
+	)
+	err = workspace.DownloadFileContext(context.Background(), server.URL, destpath, &workspace.DownloadOptions{
+		Checksum: baddigest,
+	})
+
+	var mismatch *workspace.ChecksumMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Logf("Expected a ChecksumMismatchError, got: %v", err)
+		t.Fail()
+	}
+
+	if _, err = os.Stat(destpath); !os.IsNotExist(err) {
+		t.Log("Mismatched download should not have been saved.")
+		t.Fail()
+	}
+
+	if _, err = workspace.ParseDigest("md5:abcd"); err == nil {
+		t.Log("ParseDigest should not have accepted an unsupported algorithm.")
+		t.Fail()
+	}
+}
+
+func TestChecksumManifest(t *testing.T) {
+	tdir := t.TempDir()
+	imagepath := filepath.Join(tdir, "node.img")
+	os.WriteFile(imagepath, []byte("node image"), 0644)
+	checksum, _ := workspace.ChecksumFile(imagepath)
+
+	const othersum = "0000000000000000000000000000000000000000000000000000000000000000"
+	manifests := map[string]string{
+		"GNU": "# comment\n" + checksum + "  node.img\n" + othersum + " *./tools.tar\n",
+		"BSD": "SHA256 (node.img) = " + checksum + "\nSHA256 (tools.tar) = " + othersum + "\n",
+	}
+
+	for format, text := range manifests {
+		manifest, err := workspace.ParseChecksumManifest(bytes.NewBufferString(text))
+		if err != nil {
+			t.Logf("Parsing %v manifest failed with error: %v", format, err)
+			t.Fail()
+			continue
+		}
+
+		if err = manifest.VerifyFile(imagepath, ""); err != nil {
+			t.Logf("Verifying against %v manifest failed with error: %v", format, err)
+			t.Fail()
+		}
+
+		var mismatch *workspace.ChecksumMismatchError
+		if err = manifest.VerifyFile(imagepath, "tools.tar"); !errors.As(err, &mismatch) {
+			t.Logf("Expected a mismatch against %v manifest, got: %v", format, err)
+			t.Fail()
+		}
+
+		if _, err = manifest.Lookup("notthere"); !errors.Is(err, workspace.ErrManifestEntryNotFound) {
+			t.Logf("Expected a missing entry in %v manifest, got: %v", format, err)
+			t.Fail()
+		}
+	}
+
+	_, err := workspace.ParseChecksumManifest(bytes.NewBufferString(checksum + "  ok\nnot a valid line\n"))
+	var syntaxerr *workspace.ManifestSyntaxError
+	if !errors.As(err, &syntaxerr) || syntaxerr.Line != 2 {
+		t.Logf("Expected a syntax error on line 2, got: %v", err)
+		t.Fail()
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/SHA256SUMS" {
+			w.Write([]byte(manifests["GNU"]))
+			return
+		}
+		w.Write([]byte("node image"))
+	}))
+	defer server.Close()
+
+	manifest, err := workspace.LoadChecksumManifest(context.Background(), server.URL+"/SHA256SUMS")
+	if err != nil {
+		t.Logf("LoadChecksumManifest failed with error: %v", err)
+		t.FailNow()
+	}
+
+	err = manifest.DownloadFile(context.Background(), server.URL+"/images/node.img", filepath.Join(tdir, "downloaded.img"), nil)
+	if err != nil {
+		t.Logf("Manifest-verified download failed with error: %v", err)
+		t.Fail()
+	}
+}
+
+// Signature tests
+const tsignedcontent = "signed content"
+
+// BLAKE2b-512 of tsignedcontent, as computed by a reference implementation
+const tsignedcontenthash = "d15493ef9b4e45653f5c3eb6f522ffc3ab44cbaa5e91fd5ea7971187fbcd13832e9076f6b0f1b3e48d284940484a7b919bf2418b5846ab0b6cf4af6948ce31fc"
+
+func minisignkey(seed byte) (ed25519.PrivateKey, []byte, string) {
+	privatekey := ed25519.NewKeyFromSeed(bytes.Repeat([]byte{seed}, ed25519.SeedSize))
+	keyid := bytes.Repeat([]byte{seed}, 8)
+	publickey := append(append([]byte("Ed"), keyid...), privatekey.Public().(ed25519.PublicKey)...)
+	return privatekey, keyid, base64.StdEncoding.EncodeToString(publickey)
+}
+
+func minisignsignature(privatekey ed25519.PrivateKey, keyid []byte, prehashed bool, content string) []byte {
+	algorithm, message := "Ed", []byte(content)
+	if prehashed {
+		algorithm = "ED"
+		message, _ = hex.DecodeString(tsignedcontenthash)
+	}
+
+	sig := ed25519.Sign(privatekey, message)
+	sigline := append(append([]byte(algorithm), keyid...), sig...)
+	const trustedcomment = "timestamp:0\tfile:signed.txt"
+	globalsig := ed25519.Sign(privatekey, append(sig, trustedcomment...))
+
+	return []byte("untrusted comment: signature from test key\n" +
+		base64.StdEncoding.EncodeToString(sigline) + "\n" +
+		"trusted comment: " + trustedcomment + "\n" +
+		base64.StdEncoding.EncodeToString(globalsig) + "\n")
+}
+
+func TestSignatures(t *testing.T) {
+	tdir := t.TempDir()
+	workspace.Set(tdir)
+	defer workspace.Reset()
+
+	signedpath := filepath.Join(tdir, "signed.txt")
+	os.WriteFile(signedpath, []byte(tsignedcontent), 0644)
+
+	privatekey, keyid, publickey := minisignkey(1)
+	otherkey, otherkeyid, _ := minisignkey(2)
+
+	err := workspace.AddTrustedKey("test", "untrusted comment: minisign public key\n"+publickey+"\n")
+	if err != nil {
+		t.Logf("AddTrustedKey failed with error: %v", err)
+		t.FailNow()
+	}
+
+	keys, err := workspace.ListTrustedKeys()
+	if err != nil || len(keys) != 1 || keys[0].KeyID != "0101010101010101" {
+		t.Logf("ListTrustedKeys returned %#v with error: %v", keys, err)
+		t.Fail()
+	}
+
+	for _, prehashed := range []bool{false, true} {
+		signature := minisignsignature(privatekey, keyid, prehashed, tsignedcontent)
+		err = workspace.VerifySignature(signedpath, signature)
+		if err != nil {
+			t.Logf("VerifySignature (prehashed: %v) failed with error: %v", prehashed, err)
+			t.Fail()
+		}
+	}
+
+	signature := minisignsignature(privatekey, keyid, false, "other content")
+	if err = workspace.VerifySignature(signedpath, signature); !errors.Is(err, workspace.ErrInvalidSignature) {
+		t.Logf("Expected an invalid signature, got: %v", err)
+		t.Fail()
+	}
+
+	// Legacy signatures hold the whole file in memory, so large files are
+	// refused
+	largepath := filepath.Join(tdir, "large.img")
+	largefile, _ := os.Create(largepath)
+	largefile.Truncate(workspace.MaxLegacySignedSize + 1)
+	largefile.Close()
+	signature = minisignsignature(privatekey, keyid, false, tsignedcontent)
+	if err = workspace.VerifySignature(largepath, signature); !errors.Is(err, workspace.ErrLegacySignatureTooLarge) {
+		t.Logf("Expected a legacy signature to be refused for a large file, got: %v", err)
+		t.Fail()
+	}
+	os.Remove(largepath)
+
+	signature = minisignsignature(otherkey, otherkeyid, false, tsignedcontent)
+	if err = workspace.VerifySignature(signedpath, signature); !errors.Is(err, workspace.ErrUntrustedKey) {
+		t.Logf("Expected an untrusted key, got: %v", err)
+		t.Fail()
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/signed.txt.minisig":
+			w.Write(minisignsignature(privatekey, keyid, true, tsignedcontent))
+		case "/forged.txt.minisig":
+			w.Write(minisignsignature(otherkey, otherkeyid, true, tsignedcontent))
+		default:
+			w.Write([]byte(tsignedcontent))
+		}
+	}))
+	defer server.Close()
+
+	destpath := filepath.Join(tdir, "downloaded.txt")
+	err = workspace.DownloadFileContext(context.Background(), server.URL+"/signed.txt", destpath, &workspace.DownloadOptions{
+		Signature: server.URL + "/signed.txt.minisig",
+	})
+	if err != nil {
+		t.Logf("Signed download failed with error: %v", err)
+		t.Fail()
+	}
+
+	os.Remove(destpath)
+	err = workspace.DownloadFileContext(context.Background(), server.URL+"/forged.txt", destpath, &workspace.DownloadOptions{
+		Signature: server.URL + "/forged.txt.minisig",
+	})
+	if !errors.Is(err, workspace.ErrUntrustedKey) {
+		t.Logf("Expected an untrusted key for download, got: %v", err)
+		t.Fail()
+	}
+	if _, err = os.Stat(destpath); !os.IsNotExist(err) {
+		t.Log("Download with untrusted signature should not have been saved.")
+		t.Fail()
+	}
+
+	err = workspace.RemoveTrustedKey("test")
+	if err != nil {
+		t.Logf("RemoveTrustedKey failed with error: %v", err)
+		t.Fail()
+	}
+
+	keys, _ = workspace.ListTrustedKeys()
+	if len(keys) != 0 {
+		t.Logf("Trusted key was not removed: %#v", keys)
+		t.Fail()
+	}
+}
+
+func TestDownloader(t *testing.T) {
+	tdir := t.TempDir()
+	workspace.Set(tdir)
+	defer workspace.Reset()
+
+	var gotauth, gotagent, gotproxied, gotothertoken string
+	other := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotothertoken = r.Header.Get("X-Mirror-Token")
+		w.Write([]byte("public content"))
+	}))
+	defer other.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/redirect" {
+			http.Redirect(w, r, other.URL, http.StatusFound)
+			return
+		}
+		gotauth = r.Header.Get("Authorization")
+		gotagent = r.Header.Get("User-Agent")
+		w.Write([]byte("private content"))
+	}))
+	defer server.Close()
+	serverurl, _ := url.Parse(server.URL)
+
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotproxied = r.URL.String()
+		w.Write([]byte("proxied content"))
+	}))
+	defer proxy.Close()
+
+	config, cm, err := workspace.LoadDownloaderConfig()
+	if err != nil {
+		t.Logf("LoadDownloaderConfig failed with error: %v", err)
+		t.FailNow()
+	}
+
+	config.UserAgent = "kutti-test"
+	config.HostHeaders = map[string]map[string]string{
+		serverurl.Host: {"Authorization": "Bearer token", "X-Mirror-Token": "secret"},
+	}
+	err = cm.Save()
+	if err != nil {
+		t.Logf("Saving downloader config failed with error: %v", err)
+		t.FailNow()
+	}
+
+	downloader, err := workspace.NewWorkspaceDownloader()
+	if err != nil {
+		t.Logf("NewWorkspaceDownloader failed with error: %v", err)
+		t.FailNow()
+	}
+
+	destpath := filepath.Join(tdir, "private.txt")
+	err = downloader.DownloadFile(server.URL, destpath)
+	if err != nil || gotauth != "Bearer token" || gotagent != "kutti-test" {
+		t.Logf("Download sent Authorization '%v' and User-Agent '%v', with error: %v", gotauth, gotagent, err)
+		t.Fail()
+	}
+
+	// Headers are only sent to their own host, even on a redirect
+	err = downloader.DownloadFile(other.URL, destpath)
+	if err != nil || gotothertoken != "" {
+		t.Logf("Other host received token '%v', with error: %v", gotothertoken, err)
+		t.Fail()
+	}
+	err = downloader.DownloadFile(server.URL+"/redirect", destpath)
+	if err != nil || gotothertoken != "" {
+		t.Logf("Redirected request sent token '%v', with error: %v", gotothertoken, err)
+		t.Fail()
+	}
+
+	// The package-level functions should use the default downloader
+	workspace.SetDefaultDownloader(downloader)
+	defer workspace.SetDefaultDownloader(nil)
+
+	gotauth = ""
+	err = workspace.DownloadFile(server.URL, destpath)
+	if err != nil || gotauth != "Bearer token" {
+		t.Logf("Default downloader sent Authorization '%v', with error: %v", gotauth, err)
+		t.Fail()
+	}
+
+	proxied, err := workspace.NewDownloader(&workspace.DownloaderConfig{ProxyURL: proxy.URL})
+	if err != nil {
+		t.Logf("NewDownloader failed with error: %v", err)
+		t.FailNow()
+	}
+
+	err = proxied.DownloadFile("http://kutti.example/image.img", destpath)
+	if err != nil || gotproxied != "http://kutti.example/image.img" {
+		t.Logf("Proxy received '%v', with error: %v", gotproxied, err)
+		t.Fail()
+	}
+
+	// A nil config means defaults
+	plain, err := workspace.NewDownloader(nil)
+	if err != nil || plain.Limiter.Limit() != 0 {
+		t.Logf("NewDownloader with nil config returned %v, with error: %v", plain, err)
+		t.FailNow()
+	}
+	err = plain.DownloadFile(other.URL, destpath)
+	if err != nil {
+		t.Logf("Download with default downloader failed with error: %v", err)
+		t.Fail()
+	}
+}
+
+func TestChunkedDownload(t *testing.T) {
+	data := make([]byte, 1000000)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	rangerequests := 0
+	supportranges := true
+	sendetag := true
+	overlong := false
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !supportranges {
+			w.Write(data)
+			return
+		}
+		if r.Header.Get("Range") != "" {
+			rangerequests++
+		}
+		if sendetag {
+			w.Header().Set("ETag", `"chunked"`)
+		}
+
+		var start, end int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &start, &end); overlong && err == nil {
+			// Send the requested range, followed by bytes that were not
+			// asked for.
+			w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+			w.WriteHeader(http.StatusPartialContent)
+			w.Write(data[start : end+1])
+			w.Write(bytes.Repeat([]byte{0xff}, 1000))
+			return
+		}
+		http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	tdir := t.TempDir()
+	sourcepath := filepath.Join(tdir, "source.img")
+	os.WriteFile(sourcepath, data, 0644)
+	checksum, _ := workspace.ChecksumFile(sourcepath)
+
+	var lastprogress, lasttotal int64
+	options := &workspace.DownloadOptions{
+		Chunks:       4,
+		MinChunkSize: 100000,
+		Checksum:     workspace.Digest{Algorithm: "sha256", Value: checksum},
+		Progress: func(progress int64, total int64) {
+			lastprogress, lasttotal = progress, total
+		},
+	}
+
+	destpath := filepath.Join(tdir, "chunked.img")
+	err := workspace.DownloadFileContext(context.Background(), server.URL, destpath, options)
+	if err != nil {
+		t.Logf("Chunked download failed with error: %v", err)
+		t.FailNow()
+	}
+
+	// One probe, and one request per chunk
+	if rangerequests != 5 {
+		t.Logf("Expected 5 range requests, got %v", rangerequests)
+		t.Fail()
+	}
+
+	if lastprogress != int64(len(data)) || lasttotal != int64(len(data)) {
+		t.Logf("Final progress was %v of %v bytes.", lastprogress, lasttotal)
+		t.Fail()
+	}
+
+	// Bytes beyond the requested range are ignored
+	overlong = true
+	os.Remove(destpath)
+	err = workspace.DownloadFileContext(context.Background(), server.URL, destpath, options)
+	if err != nil {
+		t.Logf("Chunked download with overlong ranges failed with error: %v", err)
+		t.Fail()
+	}
+	overlong = false
+
+	// Without a validator, chunks could come from different versions of
+	// the file, so a single stream is used
+	sendetag = false
+	rangerequests = 0
+	os.Remove(destpath)
+	err = workspace.DownloadFileContext(context.Background(), server.URL, destpath, options)
+	if err != nil || rangerequests != 1 {
+		t.Logf("Download without validator made %v range requests, with error: %v", rangerequests, err)
+		t.Fail()
+	}
+
+	// Fall back to a single stream
+	supportranges = false
+	os.Remove(destpath)
+	err = workspace.DownloadFileContext(context.Background(), server.URL, destpath, options)
+	if err != nil {
+		t.Logf("Fallback download failed with error: %v", err)
+		t.FailNow()
+	}
+
+	downloaded, _ := os.ReadFile(destpath)
+	if !bytes.Equal(downloaded, data) {
+		t.Log("Fallback download does not match source.")
+		t.Fail()
+	}
+}
+
+func TestConcurrentDownloads(t *testing.T) {
+	requests := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		time.Sleep(100 * time.Millisecond)
+		w.Write([]byte("shared content"))
+	}))
+	defer server.Close()
+
+	destpath := filepath.Join(t.TempDir(), "shared.txt")
+	results := make(chan error, 2)
+	progresscalls := make([]int, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			results <- workspace.DownloadFileWithProgress(server.URL, destpath, func(progress int64, total int64) {
+				progresscalls[i]++
+			})
+		}()
+		time.Sleep(20 * time.Millisecond)
+	}
+
+	for i := 0; i < 2; i++ {
+		if err := <-results; err != nil {
+			t.Logf("Concurrent download failed with error: %v", err)
+			t.Fail()
+		}
+	}
+
+	if requests != 1 {
+		t.Logf("Expected a single transfer, got %v", requests)
+		t.Fail()
+	}
+
+	if progresscalls[0] == 0 || progresscalls[1] == 0 {
+		t.Logf("Both callers should have received progress. Got %v", progresscalls)
+		t.Fail()
+	}
+
+	// A caller that joins is still held to its own checksum
+	go func() {
+		results <- workspace.DownloadFile(server.URL, destpath)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	err := workspace.DownloadFileContext(context.Background(), server.URL, destpath, &workspace.DownloadOptions{
+		Checksum: workspace.Digest{Algorithm: "sha256", Value: strings.Repeat("0", 64)},
+	})
+	var mismatch *workspace.ChecksumMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Logf("Joined download with a wrong checksum returned: %v", err)
+		t.Fail()
+	}
+	if err := <-results; err != nil {
+		t.Logf("Download without a checksum failed with error: %v", err)
+		t.Fail()
+	}
+
+	// A caller that gives up stops receiving progress
+	go func() {
+		results <- workspace.DownloadFile(server.URL, destpath)
+	}()
+	time.Sleep(20 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	var (
+		abandonedlock  sync.Mutex
+		abandonedcalls int
+	)
+	err = workspace.DownloadFileContext(ctx, server.URL, destpath, &workspace.DownloadOptions{
+		Progress: func(progress int64, total int64) {
+			abandonedlock.Lock()
+			abandonedcalls++
+			abandonedlock.Unlock()
+		},
+	})
+	cancel()
+	if err == nil {
+		t.Log("Abandoned download should have returned an error")
+		t.Fail()
+	}
+	<-results
+	abandonedlock.Lock()
+	defer abandonedlock.Unlock()
+	if abandonedcalls != 0 {
+		t.Logf("Abandoned caller received %v progress calls after returning", abandonedcalls)
+		t.Fail()
+	}
+
+	// Simulate another process holding the lock, and completing the download
+	lockpath := destpath + ".lock"
+	os.WriteFile(lockpath, []byte("0\n"), 0644)
+	go func() {
+		time.Sleep(200 * time.Millisecond)
+		os.WriteFile(destpath, []byte("shared content"), 0644)
+		os.Remove(lockpath)
+	}()
+
+	requests = 0
+	err = workspace.DownloadFile(server.URL, destpath)
+	if err != nil || requests != 0 {
+		t.Logf("Download after lock release made %v requests, with error: %v", requests, err)
+		t.Fail()
+	}
+
+	// A lock left behind by a crashed process is taken over
+	os.WriteFile(lockpath, []byte("0\n"), 0644)
+	old := time.Now().Add(-time.Hour)
+	os.Chtimes(lockpath, old, old)
+	err = workspace.DownloadFile(server.URL, destpath)
+	if err != nil || requests != 1 {
+		t.Logf("Download with a stale lock made %v requests, with error: %v", requests, err)
+		t.Fail()
+	}
+	leftover, _ := filepath.Glob(destpath + ".*lock")
+	if len(leftover) != 0 {
+		t.Logf("Lock files left behind: %v", leftover)
+		t.Fail()
+	}
+}
+
+func TestRateLimit(t *testing.T) {
+	data := make([]byte, 30000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	tdir := t.TempDir()
+
+	// 30000 bytes at 100000 bytes per second, less the initial burst of
+	// 10000 bytes, should take at least 200ms.
+	start := time.Now()
+	err := workspace.DownloadFileContext(
+		context.Background(),
+		server.URL,
+		filepath.Join(tdir, "limited.img"),
+		&workspace.DownloadOptions{RateLimit: 100000},
+	)
+	if err != nil {
+		t.Logf("Rate limited download failed with error: %v", err)
+		t.FailNow()
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Logf("Rate limited download took only %v", elapsed)
+		t.Fail()
+	}
+
+	start = time.Now()
+	err = workspace.CopyFileWithOptions(
+		filepath.Join(tdir, "limited.img"),
+		filepath.Join(tdir, "copied.img"),
+		&workspace.CopyOptions{RateLimit: 100000},
+	)
+	if err != nil {
+		t.Logf("Rate limited copy failed with error: %v", err)
+		t.FailNow()
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Logf("Rate limited copy took only %v", elapsed)
+		t.Fail()
+	}
+	copied, _ := os.ReadFile(filepath.Join(tdir, "copied.img"))
+	if !bytes.Equal(copied, data) {
+		t.Log("Rate limited copy does not match source.")
+		t.Fail()
+	}
+
+	// A cancelled context interrupts a throttled download
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = workspace.DownloadFileContext(
+		ctx,
+		server.URL,
+		filepath.Join(tdir, "cancelled.img"),
+		&workspace.DownloadOptions{RateLimit: 10000},
+	)
+	if !errors.Is(err, workspace.ErrDownloadCancelled) {
+		t.Logf("Expected cancellation, got: %v", err)
+		t.Fail()
+	}
+
+	// A global limit saved in the workspace config applies to copies
+	workspace.Set(tdir)
+	defer workspace.Reset()
+	defer workspace.SetRateLimit(0)
+
+	config, cm, err := workspace.LoadDownloaderConfig()
+	if err != nil {
+		t.Logf("LoadDownloaderConfig failed with error: %v", err)
+		t.FailNow()
+	}
+	config.GlobalRateLimit = 100000
+	if err = cm.Save(); err != nil {
+		t.Logf("Saving downloader config failed with error: %v", err)
+		t.FailNow()
+	}
+	if err = workspace.LoadWorkspaceRateLimit(); err != nil {
+		t.Logf("LoadWorkspaceRateLimit failed with error: %v", err)
+		t.FailNow()
+	}
+	if limiter := workspace.GlobalRateLimiter(); limiter == nil || limiter.Limit() != 100000 {
+		t.Logf("Global rate limiter was not set from config: %v", limiter)
+		t.FailNow()
+	}
+
+	start = time.Now()
+	err = workspace.CopyFile(filepath.Join(tdir, "limited.img"), filepath.Join(tdir, "configured.img"), 1000, false)
+	if err != nil {
+		t.Logf("Copy limited by config failed with error: %v", err)
+		t.FailNow()
+	}
+	if elapsed := time.Since(start); elapsed < 150*time.Millisecond {
+		t.Logf("Copy limited by config took only %v", elapsed)
+		t.Fail()
+	}
+
+	// Creating a downloader leaves a limit set by the program alone
+	config.GlobalRateLimit = 0
+	if err = cm.Save(); err != nil {
+		t.Logf("Saving downloader config failed with error: %v", err)
+		t.FailNow()
+	}
+	workspace.SetRateLimit(50000)
+	if _, err = workspace.NewWorkspaceDownloader(); err != nil {
+		t.Logf("NewWorkspaceDownloader failed with error: %v", err)
+		t.FailNow()
+	}
+	if limit := workspace.GlobalRateLimiter().Limit(); limit != 50000 {
+		t.Logf("Global rate limit changed to %v by creating a downloader", limit)
+		t.Fail()
+	}
+}
+
+func TestDecompressedDownload(t *testing.T) {
+	data := bytes.Repeat([]byte("kutti node image "), 10000)
+	var compressed bytes.Buffer
+	zw := gzip.NewWriter(&compressed)
+	zw.Write(data)
+	zw.Close()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/image" {
+			w.Header().Set("Content-Type", "application/gzip")
+		}
+		w.Write(compressed.Bytes())
+	}))
+	defer server.Close()
+
+	tdir := t.TempDir()
+	compressedsum := sha256.Sum256(compressed.Bytes())
+	decompressedsum := sha256.Sum256(data)
+
+	// Detected from the extension, verifying the compressed stream
+	var received, written int64
+	destpath := filepath.Join(tdir, "image.img")
+	err := workspace.DownloadFileContext(
+		context.Background(),
+		server.URL+"/image.img.gz",
+		destpath,
+		&workspace.DownloadOptions{
+			Decompress: workspace.DecompressAuto,
+			Checksum:   workspace.Digest{Algorithm: "sha256", Value: hex.EncodeToString(compressedsum[:])},
+			Progress: func(progress int64, total int64) {
+				received = progress
+			},
+			DecompressedProgress: func(progress int64, total int64) {
+				written = progress
+			},
+		},
+	)
+	if err != nil {
+		t.Logf("Decompressed download failed with error: %v", err)
+		t.FailNow()
+	}
+	if received != int64(compressed.Len()) || written != int64(len(data)) {
+		t.Logf("Progress reported %v bytes received and %v written.", received, written)
+		t.Fail()
+	}
+	downloaded, _ := os.ReadFile(destpath)
+	if !bytes.Equal(downloaded, data) {
+		t.Log("Decompressed download does not match source.")
+		t.Fail()
+	}
+
+	// Detected from the Content-Type, verifying the decompressed stream
+	os.Remove(destpath)
+	err = workspace.DownloadFileContext(
+		context.Background(),
+		server.URL+"/image",
+		destpath,
+		&workspace.DownloadOptions{
+			Decompress:           workspace.DecompressAuto,
+			Checksum:             workspace.Digest{Algorithm: "sha256", Value: hex.EncodeToString(decompressedsum[:])},
+			ChecksumDecompressed: true,
+		},
+	)
+	if err != nil {
+		t.Logf("Decompressed download failed with error: %v", err)
+		t.FailNow()
+	}
+
+	// Verifying the wrong stream fails
+	os.Remove(destpath)
+	err = workspace.DownloadFileContext(
+		context.Background(),
+		server.URL+"/data",
+		destpath,
+		&workspace.DownloadOptions{
+			Decompress: "gzip",
+			Checksum:   workspace.Digest{Algorithm: "sha256", Value: hex.EncodeToString(decompressedsum[:])},
+		},
+	)
+	var mismatch *workspace.ChecksumMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Logf("Expected checksum mismatch, got: %v", err)
+		t.Fail()
+	}
+
+	err = workspace.DownloadFile(server.URL+"/data", destpath)
+	if err != nil {
+		t.Logf("Plain download failed with error: %v", err)
+		t.FailNow()
+	}
+	downloaded, _ = os.ReadFile(destpath)
+	if !bytes.Equal(downloaded, compressed.Bytes()) {
+		t.Log("Plain download should not be decompressed.")
+		t.Fail()
+	}
+
+	err = workspace.DownloadFileContext(
+		context.Background(),
+		server.URL+"/image.img.lz4",
+		destpath,
+		&workspace.DownloadOptions{Decompress: "lz4"},
+	)
+	if !errors.Is(err, workspace.ErrUnsupportedCompression) {
+		t.Logf("Expected unsupported compression, got: %v", err)
+		t.Fail()
+	}
+
+	// The xz and zstd formats are built in
+	var xzcompressed, zstdcompressed bytes.Buffer
+	xw, _ := xz.NewWriter(&xzcompressed)
+	xw.Write(data)
+	xw.Close()
+	zstdw, _ := zstd.NewWriter(&zstdcompressed)
+	zstdw.Write(data)
+	zstdw.Close()
+
+	formatserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/image.img.xz":
+			w.Write(xzcompressed.Bytes())
+		case "/image.img.zst":
+			w.Write(zstdcompressed.Bytes())
+		case "/image-xz":
+			w.Header().Set("Content-Type", "application/x-xz")
+			w.Write(xzcompressed.Bytes())
+		case "/image-zstd":
+			w.Header().Set("Content-Type", "application/zstd")
+			w.Write(zstdcompressed.Bytes())
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer formatserver.Close()
+
+	for _, name := range []string{"image.img.xz", "image.img.zst", "image-xz", "image-zstd"} {
+		os.Remove(destpath)
+		err = workspace.DownloadFileContext(
+			context.Background(),
+			formatserver.URL+"/"+name,
+			destpath,
+			&workspace.DownloadOptions{Decompress: workspace.DecompressAuto},
+		)
+		if err != nil {
+			t.Logf("Decompressed download of %s failed with error: %v", name, err)
+			t.Fail()
+			continue
+		}
+		downloaded, _ = os.ReadFile(destpath)
+		if !bytes.Equal(downloaded, data) {
+			t.Logf("Decompressed download of %s does not match source.", name)
+			t.Fail()
+		}
+	}
+}
+
+type testarchiveentry struct {
+	name     string
+	typeflag byte
+	mode     int64
+	body     string
+	linkname string
+}
+
+func writetestarchive(t *testing.T, path string, entries []testarchiveentry) {
+	var buf bytes.Buffer
+	var zw io.WriteCloser
+	switch {
+	case strings.HasSuffix(path, ".xz") || strings.HasSuffix(path, ".txz"):
+		zw, _ = xz.NewWriter(&buf)
+	case strings.HasSuffix(path, ".zst") || strings.HasSuffix(path, ".tzst"):
+		zw, _ = zstd.NewWriter(&buf)
+	default:
+		zw = gzip.NewWriter(&buf)
+	}
+	tw := tar.NewWriter(zw)
+	for _, entry := range entries {
+		tw.WriteHeader(&tar.Header{
+			Name:     entry.name,
+			Typeflag: entry.typeflag,
+			Mode:     entry.mode,
+			Size:     int64(len(entry.body)),
+			Linkname: entry.linkname,
+		})
+		tw.Write([]byte(entry.body))
+	}
+	tw.Close()
+	zw.Close()
+
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	tdir := t.TempDir()
+	archivepath := filepath.Join(tdir, "bundle.tgz")
+	writetestarchive(t, archivepath, []testarchiveentry{
+		{name: "bin/", typeflag: tar.TypeDir, mode: 0755},
+		{name: "bin/tool", typeflag: tar.TypeReg, mode: 0755, body: "#!/bin/sh\n"},
+		{name: "README", typeflag: tar.TypeReg, mode: 0644, body: "read me"},
+		{name: "docs/README", typeflag: tar.TypeSymlink, linkname: "../README"},
+		{name: "README.copy", typeflag: tar.TypeLink, linkname: "README"},
+	})
+
+	var lastprogress, lasttotal int64
+	destdir := filepath.Join(tdir, "extracted")
+	err := workspace.ExtractArchive(archivepath, destdir, &workspace.ExtractOptions{
+		Progress: func(progress int64, total int64) {
+			lastprogress, lasttotal = progress, total
+		},
+	})
+	if err != nil {
+		t.Logf("Extraction failed with error: %v", err)
+		t.FailNow()
+	}
+
+	toolinfo, err := os.Stat(filepath.Join(destdir, "bin", "tool"))
+	if err != nil || toolinfo.Mode().Perm() != 0755 {
+		t.Logf("Extracted tool should be executable: %v, %v", toolinfo, err)
+		t.Fail()
+	}
+	for _, name := range []string{"docs/README", "README.copy"} {
+		data, err := os.ReadFile(filepath.Join(destdir, filepath.FromSlash(name)))
+		if err != nil || string(data) != "read me" {
+			t.Logf("Link %s contains %q, with error: %v", name, data, err)
+			t.Fail()
+		}
+	}
+	if lastprogress == 0 || lastprogress != lasttotal {
+		t.Logf("Final progress was %v of %v bytes.", lastprogress, lasttotal)
+		t.Fail()
+	}
+
+	// Other built-in compression formats, detected from the file name
+	for _, name := range []string{"bundle.tar.xz", "bundle.txz", "bundle.tar.zst", "bundle.tzst"} {
+		compressedpath := filepath.Join(tdir, name)
+		writetestarchive(t, compressedpath, []testarchiveentry{
+			{name: "README", typeflag: tar.TypeReg, mode: 0644, body: "read me"},
+		})
+
+		compresseddir := filepath.Join(tdir, "extracted-"+name)
+		err := workspace.ExtractArchive(compressedpath, compresseddir, nil)
+		if err != nil {
+			t.Logf("Extracting %s failed with error: %v", name, err)
+			t.Fail()
+			continue
+		}
+		data, _ := os.ReadFile(filepath.Join(compresseddir, "README"))
+		if string(data) != "read me" {
+			t.Logf("File extracted from %s contains %q.", name, data)
+			t.Fail()
+		}
+	}
+
+	unsafearchives := map[string][]testarchiveentry{
+		"traversal": {
+			{name: "../evil", typeflag: tar.TypeReg, mode: 0644, body: "evil"},
+		},
+		"absolute": {
+			{name: "/evil", typeflag: tar.TypeReg, mode: 0644, body: "evil"},
+		},
+		"symlinkescape": {
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "../../evil"},
+		},
+		"throughsymlink": {
+			{name: "sub/", typeflag: tar.TypeDir, mode: 0755},
+			{name: "link", typeflag: tar.TypeSymlink, linkname: "sub"},
+			{name: "link/evil", typeflag: tar.TypeReg, mode: 0644, body: "evil"},
+		},
+		"symlinkchain": {
+			{name: "a", typeflag: tar.TypeSymlink, linkname: "."},
+			{name: "b", typeflag: tar.TypeSymlink, linkname: "a/.."},
+		},
+		"symlinklaterchain": {
+			{name: "b", typeflag: tar.TypeSymlink, linkname: "a/.."},
+			{name: "a", typeflag: tar.TypeSymlink, linkname: "."},
+		},
+	}
+	for name, entries := range unsafearchives {
+		unsafepath := filepath.Join(tdir, name+".tar.gz")
+		writetestarchive(t, unsafepath, entries)
+
+		err := workspace.ExtractArchive(unsafepath, filepath.Join(tdir, name), nil)
+		var unsafeerr *workspace.UnsafeArchiveEntryError
+		if !errors.As(err, &unsafeerr) {
+			t.Logf("Archive %s: expected an unsafe entry error, got: %v", name, err)
+			t.Fail()
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tdir, "evil")); err == nil {
+		t.Log("Unsafe archive wrote outside its destination.")
+		t.Fail()
+	}
+
+	// Zip archives, and limits
+	zippath := filepath.Join(tdir, "bundle.zip")
+	zipfile, _ := os.Create(zippath)
+	zw := zip.NewWriter(zipfile)
+	w, _ := zw.Create("data/big.bin")
+	w.Write(bytes.Repeat([]byte{0}, 100000))
+	w, _ = zw.Create("../evil")
+	w.Write([]byte("evil"))
+	zw.Close()
+	zipfile.Close()
+
+	err = workspace.ExtractArchive(zippath, filepath.Join(tdir, "bomb"), &workspace.ExtractOptions{MaxSize: 1000})
+	if !errors.Is(err, workspace.ErrArchiveLimitExceeded) {
+		t.Logf("Expected limit exceeded, got: %v", err)
+		t.Fail()
+	}
+
+	err = workspace.ExtractArchive(zippath, filepath.Join(tdir, "zipslip"), nil)
+	var unsafeerr *workspace.UnsafeArchiveEntryError
+	if !errors.As(err, &unsafeerr) {
+		t.Logf("Expected an unsafe entry error, got: %v", err)
+		t.Fail()
+	}
+	data, _ := os.ReadFile(filepath.Join(tdir, "zipslip", "data", "big.bin"))
+	if len(data) != 100000 {
+		t.Logf("Extracted zip file has %v bytes.", len(data))
+		t.Fail()
+	}
+}
+
+func TestCreateArchive(t *testing.T) {
+	tdir := t.TempDir()
+	srcdir := filepath.Join(tdir, "bundle")
+	os.MkdirAll(filepath.Join(srcdir, "logs", "old"), 0755)
+	os.MkdirAll(filepath.Join(srcdir, "config"), 0755)
+	os.WriteFile(filepath.Join(srcdir, "config", "cluster.json"), []byte(`{"name":"test"}`), 0644)
+	os.WriteFile(filepath.Join(srcdir, "logs", "node.log"), []byte("log line\n"), 0600)
+	os.WriteFile(filepath.Join(srcdir, "logs", "old", "node.log"), []byte("old log line\n"), 0600)
+	os.WriteFile(filepath.Join(srcdir, "node.img"), bytes.Repeat([]byte{1}, 1000), 0644)
+	os.Symlink("config/cluster.json", filepath.Join(srcdir, "cluster.json"))
+
+	formats := []struct {
+		format      string
+		compression string
+	}{
+		{format: "tar", compression: "gzip"},
+		{format: "tar", compression: "xz"},
+		{format: "tar", compression: "zstd"},
+		{format: "zip"},
+	}
+	for _, archiveformat := range formats {
+		format := archiveformat.format
+		if archiveformat.compression != "" {
+			format += "." + archiveformat.compression
+		}
+		options := &workspace.CreateArchiveOptions{
+			Format:      archiveformat.format,
+			Compression: archiveformat.compression,
+			Exclude:     []string{"*.img", "logs/old"},
+		}
+
+		archivepath := filepath.Join(tdir, "bundle."+format)
+		checksums := make([]string, 2)
+		for i := range checksums {
+			f, _ := os.Create(archivepath)
+			err := workspace.CreateArchive(srcdir, f, options)
+			f.Close()
+			if err != nil {
+				t.Logf("Creating %s archive failed with error: %v", format, err)
+				t.FailNow()
+			}
+			checksums[i], _ = workspace.ChecksumFile(archivepath)
+
+			// A later modification time should not change the archive
+			now := time.Now().Add(time.Hour)
+			os.Chtimes(filepath.Join(srcdir, "logs", "node.log"), now, now)
+		}
+		if checksums[0] != checksums[1] {
+			t.Logf("Creating %s archive twice gave different checksums.", format)
+			t.Fail()
+		}
+
+		destdir := filepath.Join(tdir, "extracted-"+format)
+		err := workspace.ExtractArchive(archivepath, destdir, &workspace.ExtractOptions{
+			Format:      archiveformat.format,
+			Compression: archiveformat.compression,
+		})
+		if err != nil {
+			t.Logf("Extracting %s archive failed with error: %v", format, err)
+			t.FailNow()
+		}
+
+		data, err := os.ReadFile(filepath.Join(destdir, "cluster.json"))
+		if err != nil || string(data) != `{"name":"test"}` {
+			t.Logf("Linked file in %s archive contains %q, with error: %v", format, data, err)
+			t.Fail()
+		}
+		loginfo, err := os.Stat(filepath.Join(destdir, "logs", "node.log"))
+		if err != nil || loginfo.Mode().Perm() != 0600 {
+			t.Logf("Log file in %s archive has mode %v, with error: %v", format, loginfo, err)
+			t.Fail()
+		}
+		for _, excluded := range []string{"node.img", "logs/old"} {
+			if _, err := os.Stat(filepath.Join(destdir, excluded)); err == nil {
+				t.Logf("Excluded %s found in %s archive.", excluded, format)
+				t.Fail()
+			}
+		}
+	}
+
+	// Include patterns, with progress
+	var buf bytes.Buffer
+	var lastprogress, lasttotal int64
+	err := workspace.CreateArchive(srcdir, &buf, &workspace.CreateArchiveOptions{
+		Include: []string{"*.log"},
+		Progress: func(progress int64, total int64) {
+			lastprogress, lasttotal = progress, total
+		},
+	})
+	if err != nil {
+		t.Logf("Creating archive failed with error: %v", err)
+		t.FailNow()
+	}
+
+	var names []string
+	tr := tar.NewReader(&buf)
+	for {
+		header, err := tr.Next()
+		if err != nil {
+			break
+		}
+		names = append(names, header.Name)
+	}
+	expected := []string{"logs/", "logs/node.log", "logs/old/", "logs/old/node.log"}
+	if fmt.Sprint(names) != fmt.Sprint(expected) {
+		t.Logf("Expected entries %v, got %v", expected, names)
+		t.Fail()
+	}
+	if lastprogress != 22 || lasttotal != 22 {
+		t.Logf("Final progress was %v of %v bytes.", lastprogress, lasttotal)
+		t.Fail()
+	}
+}
+
+func TestLocalAndCustomURLs(t *testing.T) {
+	tdir := t.TempDir()
+	sourcepath := filepath.Join(tdir, "source.img")
+	data := bytes.Repeat([]byte("local image "), 1000)
+	os.WriteFile(sourcepath, data, 0644)
+
+	sources := map[string]string{
+		"path":    sourcepath,
+		"fileurl": "file://" + filepath.ToSlash(sourcepath),
+	}
+	if !strings.HasPrefix(sources["fileurl"], "file:///") {
+		sources["fileurl"] = "file:///" + filepath.ToSlash(sourcepath)
+	}
+	for name, source := range sources {
+		var lastprogress, lasttotal int64
+		destpath := filepath.Join(tdir, name+".img")
+		err := workspace.DownloadFileWithProgress(source, destpath, func(progress int64, total int64) {
+			lastprogress, lasttotal = progress, total
+		})
+		if err != nil {
+			t.Logf("Download from %s failed with error: %v", source, err)
+			t.Fail()
+			continue
+		}
+
+		downloaded, _ := os.ReadFile(destpath)
+		if !bytes.Equal(downloaded, data) {
+			t.Logf("Download from %s does not match source.", source)
+			t.Fail()
+		}
+		if lastprogress != int64(len(data)) || lasttotal != int64(len(data)) {
+			t.Logf("Download from %s: final progress was %v of %v bytes.", source, lastprogress, lasttotal)
+			t.Fail()
+		}
+		if _, err := os.Stat(destpath + ".download"); err == nil {
+			t.Logf("Download from %s left a temporary file.", source)
+			t.Fail()
+		}
+	}
+
+	dataurls := map[string]string{
+		"data:text/plain;base64,aGVsbG8sIHdvcmxk": "hello, world",
+		"data:,hello%2C%20world":                  "hello, world",
+	}
+	for dataurl, expected := range dataurls {
+		destpath := filepath.Join(tdir, "data.txt")
+		err := workspace.DownloadFile(dataurl, destpath)
+		downloaded, _ := os.ReadFile(destpath)
+		if err != nil || string(downloaded) != expected {
+			t.Logf("Download of %s gave %q, with error: %v", dataurl, downloaded, err)
+			t.Fail()
+		}
+	}
+
+	err := workspace.RegisterFetcher("test", func(ctx context.Context, u *url.URL) (io.ReadCloser, int64, error) {
+		if u.Host != "bucket" {
+			return nil, 0, os.ErrNotExist
+		}
+		return io.NopCloser(strings.NewReader(u.Path)), -1, nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destpath := filepath.Join(tdir, "custom.txt")
+	err = workspace.DownloadFile("test://bucket/some/object", destpath)
+	downloaded, _ := os.ReadFile(destpath)
+	if err != nil || string(downloaded) != "/some/object" {
+		t.Logf("Custom download gave %q, with error: %v", downloaded, err)
+		t.Fail()
+	}
+
+	err = workspace.DownloadFile("test://elsewhere/object", destpath)
+	if !errors.Is(err, os.ErrNotExist) {
+		t.Logf("Expected the fetcher's error, got: %v", err)
+		t.Fail()
+	}
+
+	err = workspace.DownloadFile("gopher://example.com/object", destpath)
+	if err == nil {
+		t.Log("Unsupported scheme should have failed.")
+		t.Fail()
+	}
+
+	if err := workspace.RegisterFetcher("https", nil); err == nil {
+		t.Log("Registering https should have failed.")
+		t.Fail()
+	}
+}
+
+func TestOCIArtifacts(t *testing.T) {
+	image := bytes.Repeat([]byte("node image "), 1000)
+	checksums := []byte("checksums")
+	tampered := false
+
+	blobs := map[string][]byte{}
+	adddigest := func(data []byte) string {
+		sum := sha256.Sum256(data)
+		digest := "sha256:" + hex.EncodeToString(sum[:])
+		blobs[digest] = data
+		return digest
+	}
+	layer := func(data []byte, title string) map[string]any {
+		return map[string]any{
+			"mediaType":   "application/octet-stream",
+			"digest":      adddigest(data),
+			"size":        len(data),
+			"annotations": map[string]string{"org.opencontainers.image.title": title},
+		}
+	}
+	manifest, _ := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.manifest.v1+json",
+		"layers":        []any{layer(image, "node.img"), layer(checksums, "SHA256SUMS")},
+	})
+	manifestdigest := adddigest(manifest)
+	index, _ := json.Marshal(map[string]any{
+		"schemaVersion": 2,
+		"mediaType":     "application/vnd.oci.image.index.v1+json",
+		"manifests": []any{map[string]any{
+			"mediaType": "application/vnd.oci.image.manifest.v1+json",
+			"digest":    manifestdigest,
+			"size":      len(manifest),
+			"platform":  map[string]string{"os": "linux", "architecture": "amd64"},
+		}},
+	})
+
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/token" {
+			if r.URL.Query().Get("scope") != "repository:kutti/images:pull" {
+				http.Error(w, "bad scope", http.StatusBadRequest)
+				return
+			}
+			w.Write([]byte(`{"token":"secret"}`))
+			return
+		}
+
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="`+server.URL+`/token",service="test"`)
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		name, reference, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/v2/kutti/images/"), "/")
+		switch {
+		case name == "manifests" && reference == "v1":
+			w.Header().Set("Content-Type", "application/vnd.oci.image.index.v1+json")
+			w.Write(index)
+		case name == "manifests" && reference == manifestdigest:
+			w.Header().Set("Content-Type", "application/vnd.oci.image.manifest.v1+json")
+			w.Write(manifest)
+		case name == "blobs" && blobs[reference] != nil:
+			data := blobs[reference]
+			if tampered {
+				data = bytes.ToUpper(data)
+			}
+			w.Write(data)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	registry := strings.TrimPrefix(server.URL, "http://")
+	ref, err := workspace.ParseOCIReference(registry + "/kutti/images:v1")
+	if err != nil || ref.Repository != "kutti/images" || ref.Tag != "v1" {
+		t.Logf("Parsed reference as %+v, with error: %v", ref, err)
+		t.Fail()
+	}
+
+	tdir := t.TempDir()
+	var lastprogress, lasttotal int64
+	destpath := filepath.Join(tdir, "node.img")
+	err = workspace.DownloadFileWithProgress(
+		"oci://"+registry+"/kutti/images:v1?file=node.img&platform=linux/amd64",
+		destpath,
+		func(progress int64, total int64) {
+			lastprogress, lasttotal = progress, total
+		},
+	)
+	if err != nil {
+		t.Logf("OCI download failed with error: %v", err)
+		t.FailNow()
+	}
+	downloaded, _ := os.ReadFile(destpath)
+	if !bytes.Equal(downloaded, image) {
+		t.Log("OCI download does not match the layer.")
+		t.Fail()
+	}
+	if lastprogress != int64(len(image)) || lasttotal != int64(len(image)) {
+		t.Logf("Final progress was %v of %v bytes.", lastprogress, lasttotal)
+		t.Fail()
+	}
+
+	// By manifest digest
+	err = workspace.DownloadFile(
+		"oci://"+registry+"/kutti/images@"+manifestdigest+"?file=SHA256SUMS",
+		filepath.Join(tdir, "SHA256SUMS"),
+	)
+	if err != nil {
+		t.Logf("OCI download by digest failed with error: %v", err)
+		t.Fail()
+	}
+
+	err = workspace.DownloadFile("oci://"+registry+"/kutti/images:v1?platform=linux/amd64", destpath)
+	if err == nil {
+		t.Log("Choosing between several layers should have failed.")
+		t.Fail()
+	}
+
+	tampered = true
+	err = workspace.DownloadFileContext(
+		context.Background(),
+		"oci://"+registry+"/kutti/images:v1?file=node.img&platform=linux/amd64",
+		filepath.Join(tdir, "tampered.img"),
+		&workspace.DownloadOptions{Retry: &workspace.RetryPolicy{MaxAttempts: 1}},
+	)
+	var mismatch *workspace.ChecksumMismatchError
+	if !errors.As(err, &mismatch) {
+		t.Logf("Expected checksum mismatch, got: %v", err)
+		t.Fail()
+	}
+	if _, err := os.Stat(filepath.Join(tdir, "tampered.img")); err == nil {
+		t.Log("Tampered layer should not have been saved.")
+		t.Fail()
+	}
+}
+
+func TestDownloadBatch(t *testing.T) {
+	files := map[string]string{
+		"/node.img":   strings.Repeat("node image ", 1000),
+		"/kubeadm":    "kubeadm binary",
+		"/SHA256SUMS": "checksums",
+	}
+	var requestslock sync.Mutex
+	requests := map[string]int{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestslock.Lock()
+		requests[r.URL.Path]++
+		requestslock.Unlock()
+
+		content, ok := files[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+		w.Write([]byte(content))
+	}))
+	defer server.Close()
+
+	kubeadmsum := sha256.Sum256([]byte(files["/kubeadm"]))
+	manifestjson := fmt.Sprintf(`{
+		"items": [
+			{"url": "%[1]s/node.img", "destination": "images/node.img"},
+			{"url": "%[1]s/kubeadm", "destination": "bin/kubeadm", "checksum": "sha256:%[2]s"},
+			{"url": "%[1]s/SHA256SUMS", "destination": "SHA256SUMS"},
+			{"url": "%[1]s/extras.tar", "destination": "extras.tar", "optional": true}
+		]
+	}`, server.URL, hex.EncodeToString(kubeadmsum[:]))
+
+	tdir := t.TempDir()
+	manifestpath := filepath.Join(tdir, "batch.json")
+	os.WriteFile(manifestpath, []byte(manifestjson), 0644)
+	manifest, err := workspace.LoadBatchManifest(manifestpath)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	destdir := filepath.Join(tdir, "cluster")
+	os.MkdirAll(filepath.Join(destdir, "images"), 0755)
+	os.MkdirAll(filepath.Join(destdir, "bin"), 0755)
+
+	var lastprogress, lasttotal int64
+	var progresslock sync.Mutex
+	options := &workspace.BatchOptions{
+		Concurrency: 2,
+		BaseDir:     destdir,
+		StatePath:   filepath.Join(tdir, "batch.state"),
+		Progress: func(progress int64, total int64) {
+			progresslock.Lock()
+			lastprogress, lasttotal = progress, total
+			progresslock.Unlock()
+		},
+	}
+	result, err := workspace.DownloadBatch(context.Background(), manifest, options)
+	if err != nil {
+		t.Logf("Batch failed with error: %v", err)
+		t.FailNow()
+	}
+
+	if result.Failed != 1 || result.Items[3].Status != workspace.BatchItemFailed {
+		t.Logf("Expected only the optional item to fail, got %+v", result)
+		t.Fail()
+	}
+	for i := 0; i < 3; i++ {
+		if result.Items[i].Status != workspace.BatchItemDone {
+			t.Logf("Item %v has status %v", i, result.Items[i].Status)
+			t.Fail()
+		}
+	}
+	expectedtotal := int64(len(files["/node.img"]) + len(files["/kubeadm"]) + len(files["/SHA256SUMS"]))
+	if lastprogress != expectedtotal || lasttotal != expectedtotal {
+		t.Logf("Final progress was %v of %v bytes.", lastprogress, lasttotal)
+		t.Fail()
+	}
+
+	// Running again skips completed items
+	requests = map[string]int{}
+	result, err = workspace.DownloadBatch(context.Background(), manifest, options)
+	if err != nil {
+		t.Logf("Second batch run failed with error: %v", err)
+		t.FailNow()
+	}
+	if result.Items[0].Status != workspace.BatchItemSkipped || requests["/node.img"] != 0 {
+		t.Logf("Completed item should have been skipped: %+v, %v requests", result.Items[0], requests["/node.img"])
+		t.Fail()
+	}
+
+	// A required item failing fails the batch
+	manifest.Items[3].Optional = false
+	_, err = workspace.DownloadBatch(context.Background(), manifest, options)
+	if !errors.Is(err, workspace.ErrBatchIncomplete) {
+		t.Logf("Expected incomplete batch, got: %v", err)
+		t.Fail()
+	}
+
+	// Items are verified against their own signatures, not one shared by
+	// all downloads
+	workspace.Set(tdir)
+	defer workspace.Reset()
+	privatekey, keyid, publickey := minisignkey(1)
+	workspace.AddTrustedKey("test", "untrusted comment: minisign public key\n"+publickey+"\n")
+	signatures := map[string][]byte{
+		"/node.img.minisig": minisignsignature(privatekey, keyid, false, files["/node.img"]),
+		"/kubeadm.minisig":  minisignsignature(privatekey, keyid, false, files["/kubeadm"]),
+	}
+	sigserver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(signatures[r.URL.Path])
+	}))
+	defer sigserver.Close()
+
+	signedmanifest := &workspace.BatchManifest{Items: []workspace.BatchItem{
+		{URL: server.URL + "/node.img", Destination: "signed/node.img", Signature: sigserver.URL + "/node.img.minisig"},
+		{URL: server.URL + "/kubeadm", Destination: "signed/kubeadm", Signature: sigserver.URL + "/kubeadm.minisig"},
+	}}
+	os.MkdirAll(filepath.Join(destdir, "signed"), 0755)
+	result, err = workspace.DownloadBatch(context.Background(), signedmanifest, &workspace.BatchOptions{
+		BaseDir:  destdir,
+		Download: &workspace.DownloadOptions{Signature: sigserver.URL + "/node.img.minisig"},
+	})
+	if err != nil {
+		t.Logf("Signed batch failed with error: %v, result: %+v", err, result)
+		t.Fail()
+	}
+}
+
+func TestProgressEvents(t *testing.T) {
+	data := bytes.Repeat([]byte("progress "), 4000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Written in pieces, so that the length is not known
+		for i := 0; i < len(data); i += 1000 {
+			w.Write(data[i : i+1000])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+
+	datasum := sha256.Sum256(data)
+	var (
+		events    []workspace.ProgressEvent
+		lasttotal int64
+	)
+	err := workspace.DownloadFileContext(
+		context.Background(),
+		server.URL,
+		filepath.Join(t.TempDir(), "progress.txt"),
+		&workspace.DownloadOptions{
+			RateLimit: 100000,
+			Checksum:  workspace.Digest{Algorithm: "sha256", Value: hex.EncodeToString(datasum[:])},
+			Progress: func(progress int64, total int64) {
+				lasttotal = total
+			},
+			OnProgress: func(event workspace.ProgressEvent) {
+				events = append(events, event)
+			},
+			ProgressInterval: 100 * time.Millisecond,
+		},
+	)
+	if err != nil {
+		t.Logf("Download failed with error: %v", err)
+		t.FailNow()
+	}
+
+	if lasttotal != 0 {
+		t.Logf("Unknown total should be reported as 0, got %v", lasttotal)
+		t.Fail()
+	}
+
+	var phases []workspace.ProgressPhase
+	for _, event := range events {
+		if len(phases) == 0 || phases[len(phases)-1] != event.Phase {
+			phases = append(phases, event.Phase)
+		}
+	}
+	expected := []workspace.ProgressPhase{
+		workspace.PhaseConnecting,
+		workspace.PhaseTransferring,
+		workspace.PhaseVerifying,
+		workspace.PhaseRenaming,
+		workspace.PhaseDone,
+	}
+	if fmt.Sprint(phases) != fmt.Sprint(expected) {
+		t.Logf("Expected phases %v, got %v", expected, phases)
+		t.Fail()
+	}
+
+	last := events[len(events)-1]
+	if last.Current != int64(len(data)) || last.AverageRate <= 0 || last.Elapsed <= 0 {
+		t.Logf("Unexpected final event: %+v", last)
+		t.Fail()
+	}
+
+	// Rapid updates are throttled, but the first and last are delivered
+	var throttled []workspace.ProgressEvent
+	progress := workspace.ProgressEvents(func(event workspace.ProgressEvent) {
+		throttled = append(throttled, event)
+	}, time.Hour)
+	for i := int64(1); i <= 1000; i++ {
+		progress(i, 1000)
+	}
+	if len(throttled) != 2 || throttled[0].Current != 1 || throttled[1].Current != 1000 {
+		t.Logf("Expected the first and last of 1000 updates, got %+v", throttled)
+		t.Fail()
+	}
+
+	// The adapter, with a known total
+	tdir := t.TempDir()
+	sourcepath := filepath.Join(tdir, "source.txt")
+	os.WriteFile(sourcepath, data, 0644)
+	var copyevents []workspace.ProgressEvent
+	err = workspace.CopyFileWithOptions(sourcepath, filepath.Join(tdir, "copy.txt"), &workspace.CopyOptions{
+		BufferSize: 1000,
+		RateLimit:  100000,
+		Progress: workspace.ProgressEvents(func(event workspace.ProgressEvent) {
+			copyevents = append(copyevents, event)
+		}, 50*time.Millisecond),
+	})
+	if err != nil {
+		t.Logf("Copy failed with error: %v", err)
+		t.FailNow()
+	}
+
+	sawETA := false
+	for _, event := range copyevents {
+		sawETA = sawETA || event.ETA > 0
+	}
+	last = copyevents[len(copyevents)-1]
+	if !sawETA || last.Current != last.Total || last.Total != int64(len(data)) {
+		t.Logf("Copy events had ETA: %v, and ended with %+v", sawETA, last)
+		t.Fail()
+	}
+}
+
+func TestProgressRenderers(t *testing.T) {
+	tdir := t.TempDir()
+	sourcepath := filepath.Join(tdir, "source.txt")
+	data := bytes.Repeat([]byte("render "), 3000)
+	os.WriteFile(sourcepath, data, 0644)
+
+	// A plain file is not a terminal, so progress is logged
+	logfile, err := os.Create(filepath.Join(tdir, "progress.log"))
+	if err != nil {
+		t.Logf("Could not create log file: %v", err)
+		t.FailNow()
+	}
+	defer logfile.Close()
+	if _, ok := workspace.NewProgressRenderer(logfile, false).(*workspace.LogRenderer); !ok {
+		t.Log("Expected a LogRenderer for output that is not a terminal")
+		t.Fail()
+	}
+
+	var bar bytes.Buffer
+	renderer := workspace.NewBarRenderer(&bar)
+	err = workspace.CopyFileWithProgress(sourcepath, filepath.Join(tdir, "bar.txt"), 1000, false, renderer.Progress("bar.txt"))
+	if err != nil {
+		t.Logf("Copy failed with error: %v", err)
+		t.FailNow()
+	}
+	renderer.Finish()
+	if !strings.HasPrefix(bar.String(), "\rbar.txt [") ||
+		!strings.Contains(bar.String(), "100% 20.5 KiB/20.5 KiB") ||
+		!strings.HasSuffix(bar.String(), "\n") {
+		t.Logf("Unexpected bar output: %q", bar.String())
+		t.Fail()
+	}
+
+	// Concurrent transfers get a line each
+	var multibar bytes.Buffer
+	multirenderer := workspace.NewMultiBarRenderer(&multibar)
+	first, second := multirenderer.Progress("first"), multirenderer.Progress("second")
+	first(10, 100)
+	second(20, 200)
+	first(100, 100)
+	lines := strings.Split(strings.TrimSuffix(multibar.String(), "\n"), "\n")
+	if len(lines) != 5 || !strings.Contains(lines[3], "\x1b[2Kfirst [") || !strings.Contains(lines[3], "100%") ||
+		!strings.HasPrefix(lines[4], "\x1b[2Ksecond [") {
+		t.Logf("Unexpected multi-bar output: %q", multibar.String())
+		t.Fail()
+	}
+
+	// Log lines are throttled, but phase changes and the end are logged
+	var logged bytes.Buffer
+	logrenderer := workspace.NewLogRenderer(&logged, time.Hour)
+	handler := logrenderer.Handler("log.txt")
+	handler(workspace.ProgressEvent{Phase: workspace.PhaseConnecting})
+	for i := int64(1); i <= 100; i++ {
+		handler(workspace.ProgressEvent{Phase: workspace.PhaseTransferring, Current: i * 1024, Total: 100 * 1024})
+	}
+	handler(workspace.ProgressEvent{Phase: workspace.PhaseDone, Current: 100 * 1024, Total: 100 * 1024})
+	lines = strings.Split(strings.TrimSuffix(logged.String(), "\n"), "\n")
+	if len(lines) != 4 || !strings.HasSuffix(lines[0], "connecting") || !strings.Contains(lines[2], "100%") ||
+		!strings.HasSuffix(lines[3], "done") {
+		t.Logf("Unexpected log output: %q", logged.String())
+		t.Fail()
+	}
+
+	var jsonlines bytes.Buffer
+	jsonrenderer := workspace.NewJSONRenderer(&jsonlines)
+	jsonrenderer.Handler("json.txt")(workspace.ProgressEvent{
+		Phase:   workspace.PhaseTransferring,
+		Current: 50,
+		Total:   100,
+		ETA:     2 * time.Second,
+	})
+	var decoded map[string]interface{}
+	if err := json.Unmarshal(jsonlines.Bytes(), &decoded); err != nil ||
+		decoded["name"] != "json.txt" || decoded["phase"] != "transferring" ||
+		decoded["current"] != float64(50) || decoded["etaseconds"] != float64(2) {
+		t.Logf("Unexpected JSON output %q, error: %v", jsonlines.String(), err)
+		t.Fail()
+	}
+}
+
+func TestFreeSpace(t *testing.T) {
+	defer workspace.SetFreeSpaceMargin(0)
+
+	tdir := t.TempDir()
+	free, err := workspace.FreeSpace(tdir)
+	if err != nil || free <= 0 {
+		t.Logf("Expected free space in %s, got %v with error: %v", tdir, free, err)
+		t.FailNow()
+	}
+
+	data := bytes.Repeat([]byte("space "), 1000)
+	sourcepath := filepath.Join(tdir, "source.txt")
+	os.WriteFile(sourcepath, data, 0644)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		w.Write(data)
+	}))
+	defer server.Close()
+
+	// No filesystem has room for this margin
+	workspace.SetFreeSpaceMargin(1 << 62)
+
+	copypath := filepath.Join(tdir, "copy.txt")
+	err = workspace.CopyFile(sourcepath, copypath, 1000, false)
+	var spaceerr *workspace.InsufficientSpaceError
+	if !errors.As(err, &spaceerr) || spaceerr.Required != int64(len(data))+1<<62 || spaceerr.Available <= 0 {
+		t.Logf("Expected an InsufficientSpaceError, got: %v", err)
+		t.Fail()
+	}
+	if _, err := os.Stat(copypath); !os.IsNotExist(err) {
+		t.Log("Copy should not have been started")
+		t.Fail()
+	}
+
+	downloadpath := filepath.Join(tdir, "download.txt")
+	err = workspace.DownloadFileContext(context.Background(), server.URL, downloadpath, nil)
+	if !errors.As(err, &spaceerr) {
+		t.Logf("Expected an InsufficientSpaceError, got: %v", err)
+		t.Fail()
+	}
+	if _, err := os.Stat(downloadpath + ".download"); !os.IsNotExist(err) {
+		t.Log("Download should not have been started")
+		t.Fail()
+	}
+
+	workspace.SetFreeSpaceMargin(0)
+	err = workspace.CopyFile(sourcepath, copypath, 1000, false)
+	if err != nil {
+		t.Logf("Copy failed with error: %v", err)
+		t.Fail()
+	}
+	err = workspace.DownloadFileContext(context.Background(), server.URL, downloadpath, nil)
+	if err != nil {
+		t.Logf("Download failed with error: %v", err)
+		t.Fail()
+	}
+}
+
+func TestAtomicCopy(t *testing.T) {
+	tdir := t.TempDir()
+	sourcepath := filepath.Join(tdir, "source.txt")
+	destpath := filepath.Join(tdir, "dest.txt")
+	data := bytes.Repeat([]byte("atomic "), 3000)
+	os.WriteFile(sourcepath, data, 0644)
+	os.WriteFile(destpath, []byte("old"), 0644)
+
+	// Without overwrite, an existing destination is left alone
+	err := workspace.CopyFile(sourcepath, destpath, 1000, false)
+	if err == nil {
+		t.Log("Copying without overwrite should have caused an error.")
+		t.Fail()
+	}
+
+	// While copying, the destination keeps its old contents
+	sawold := false
+	err = workspace.CopyFileWithOptions(sourcepath, destpath, &workspace.CopyOptions{
+		BufferSize: 1000,
+		Overwrite:  true,
+		Sync:       true,
+		Progress: func(current int64, total int64) {
+			if current < total {
+				contents, _ := os.ReadFile(destpath)
+				sawold = string(contents) == "old"
+			}
+		},
+	})
+	if err != nil {
+		t.Logf("Copy failed with error: %v", err)
+		t.FailNow()
+	}
+	if !sawold {
+		t.Log("Destination was modified before the copy completed")
+		t.Fail()
+	}
+	if contents, _ := os.ReadFile(destpath); !bytes.Equal(contents, data) {
+		t.Log("Destination does not have the copied contents")
+		t.Fail()
+	}
+
+	// A failed copy does not leave a partial or claimed destination
+	newpath := filepath.Join(tdir, "new.txt")
+	err = workspace.CopyFile(tdir, newpath, 1000, false)
+	if err == nil {
+		t.Log("Copying a directory should have caused an error.")
+		t.Fail()
+	}
+
+	sawnew := false
+	err = workspace.CopyFileWithOptions(sourcepath, newpath, &workspace.CopyOptions{
+		BufferSize: 1000,
+		Progress: func(current int64, total int64) {
+			if _, err := os.Lstat(newpath); err == nil {
+				sawnew = true
+			}
+			// Fail the copy part of the way through
+			os.Truncate(sourcepath, 5000)
+		},
+	})
+	if err == nil {
+		t.Log("Copying a source that shrank should have caused an error.")
+		t.Fail()
+	}
+	if sawnew {
+		t.Log("Destination was created before the copy completed.")
+		t.Fail()
+	}
+
+	entries, _ := os.ReadDir(tdir)
+	if len(entries) != 2 {
+		names := []string{}
+		for _, entry := range entries {
+			names = append(names, entry.Name())
+		}
+		t.Logf("Expected only source and destination, found %v", names)
+		t.Fail()
+	}
+}
+
+func TestVerifyCacheRefetch(t *testing.T) {
+	tdir := t.TempDir()
+	workspace.Set(tdir)
+	defer workspace.Reset()
+
+	content := []byte("refetched image")
+	lookups := make(chan error, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// The cache index must not be locked while refetching
+		done := make(chan error, 1)
+		go func() {
+			_, err := workspace.GetCacheEntry("image")
+			done <- err
+		}()
+		select {
+		case err := <-done:
+			lookups <- err
+		case <-time.After(2 * time.Second):
+			lookups <- errors.New("cache index was locked during the refetch")
+		}
+		w.Write(content)
+	}))
+	defer server.Close()
+
+	workspace.CacheSubDir("images")
+	_, err := workspace.FetchCacheEntry("image", server.URL, "images/refetch.img", time.Hour)
+	if err != nil {
+		t.Logf("FetchCacheEntry failed with error: %v", err)
+		t.FailNow()
+	}
+	<-lookups
+
+	entry, _ := workspace.GetCacheEntry("image")
+	fullpath, _ := entry.FullPath()
+	os.WriteFile(fullpath, []byte("bit-rotted image"), 0644)
+
+	result, err := workspace.VerifyCache(workspace.VerifyCacheOptions{Repair: workspace.RepairRefetch})
+	if err != nil {
+		t.Logf("VerifyCache failed with error: %v", err)
+		t.FailNow()
+	}
+	if err := <-lookups; err != nil {
+		t.Log(err)
+		t.Fail()
+	}
+	if len(result.Issues) != 1 || result.Issues[0].Repair != "refetched" {
+		t.Logf("VerifyCache returned unexpected result: %#v", result)
+		t.Fail()
+	}
+	if data, _ := os.ReadFile(fullpath); !bytes.Equal(data, content) {
+		t.Logf("Refetched file has contents %q", data)
+		t.Fail()
+	}
+}